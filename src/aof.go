@@ -2,59 +2,631 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// AOF 全局的 AOF 实例，appendonly 关闭时为 nil
+var AOF *Aof
+
+// AOF 的 fsync 策略
+const (
+	FsyncAlways   = "always"   // 每次写入后立即 fsync，在回复客户端之前完成
+	FsyncEverySec = "everysec" // 后台每秒 fsync 一次
+	FsyncNo       = "no"       // 不主动 fsync，交给操作系统刷盘
+)
+
+// aofSlowFsync fsync 超过这个时间就打印警告
+const aofSlowFsync = 2 * time.Second
+
 type Aof struct {
-	file *os.File
-	rd   *bufio.Reader
-	mu   sync.Mutex
+	path  string
+	file  *os.File
+	rd    *bufio.Reader
+	mu    sync.Mutex
+	fsync string
+	dirty bool // 上次 fsync 之后是否有新的写入
+
+	size       int64    // 当前文件大小
+	baseSize   int64    // 启动或上次重写完成时的文件大小，用于判断是否触发自动重写
+	rewriting  bool     // 是否正在进行 AOF 重写
+	rewriteBuf [][]byte // 重写期间新写入的命令，重写完成后追加到新文件末尾
+	closed     bool
+	selectedDB int // 文件中最后一条 SELECT 选择的数据库，-1 表示未知，下次写入前需要先写 SELECT
+
+	stop chan struct{}
+	done chan struct{}
 }
 
-func NewAof(path string) (*Aof, error) {
+func NewAof(path string, fsync string) (*Aof, error) {
+	if !validFsyncPolicy(fsync) {
+		return nil, errors.New("invalid appendfsync policy: " + fsync)
+	}
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
 
 	aof := &Aof{
-		file: f,
-		rd:   bufio.NewReader(f),
+		path:  path,
+		file:  f,
+		rd:    bufio.NewReader(f),
+		fsync: fsync,
+		stop:  make(chan struct{}),
+
+		selectedDB: -1,
+		done:       make(chan struct{}),
 	}
 
-	// Start a goroutine to sync AOF to disk every 1 second
-	go func() {
-		for {
-			aof.mu.Lock()
+	// 后台 goroutine，everysec 策略下每秒 fsync 一次，Close 时退出
+	go aof.syncLoop()
+
+	return aof, nil
+}
+
+func validFsyncPolicy(fsync string) bool {
+	return fsync == FsyncAlways || fsync == FsyncEverySec || fsync == FsyncNo
+}
 
-			aof.file.Sync()
+func (aof *Aof) syncLoop() {
+	defer close(aof.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-aof.stop:
+			return
+		case <-ticker.C:
+		}
 
-			aof.mu.Unlock()
+		// 文件在锁内取出：重写会替换 aof.file
+		aof.mu.Lock()
+		needSync := aof.fsync == FsyncEverySec && aof.dirty
+		aof.dirty = false
+		f := aof.file
+		aof.mu.Unlock()
 
-			time.Sleep(time.Second)
+		// fsync 期间不持有锁，避免阻塞写入
+		if needSync {
+			_ = syncFile(f)
 		}
-	}()
 
-	return aof, nil
+		aof.maybeRewrite()
+	}
+}
+
+// syncFile 调用 fsync 并通过 logger 报告耗时和错误
+func syncFile(f *os.File) error {
+	start := time.Now()
+	err := f.Sync()
+	elapsed := time.Since(start)
+	// 后台 fsync 期间重写替换并关闭了旧文件，新文件在替换之前已经 fsync 过
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	if err != nil {
+		logger.Error("AOF fsync failed: %s", err.Error())
+		return err
+	}
+	if elapsed > aofSlowFsync {
+		logger.Warning("AOF fsync is taking too long (disk is busy?): %s", elapsed)
+	} else {
+		logger.Debug("AOF fsync took %s", elapsed)
+	}
+	return nil
 }
 
+// SetFsyncPolicy 修改 fsync 策略，切换到 always 时立即把已写入的数据刷盘
+func (aof *Aof) SetFsyncPolicy(fsync string) error {
+	if !validFsyncPolicy(fsync) {
+		return errors.New("invalid appendfsync policy: " + fsync)
+	}
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.fsync = fsync
+	if fsync == FsyncAlways && aof.dirty {
+		aof.dirty = false
+		return syncFile(aof.file)
+	}
+	return nil
+}
+
+// Close 停止后台 fsync goroutine，把剩余数据刷盘后关闭文件
 func (aof *Aof) Close() error {
+	// 关闭流程（SHUTDOWN）和 main 退出时都会调用，只有第一次生效
+	aof.mu.Lock()
+	if aof.closed {
+		aof.mu.Unlock()
+		return nil
+	}
+	aof.closed = true
+	aof.mu.Unlock()
+
+	close(aof.stop)
+	<-aof.done
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	return aof.file.Close()
+	var err error
+	if aof.dirty {
+		err = syncFile(aof.file)
+	}
+	if closeErr := aof.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func (aof *Aof) Write(value Value) error {
+// Write 追加一条在数据库 db 上执行的命令，数据库和上一条命令不同时先写入 SELECT，
+// always 策略下在返回之前完成 fsync
+func (aof *Aof) Write(db int, value Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	_, err := aof.file.Write(value.Marshal())
+	var bytes []byte
+	if db != aof.selectedDB {
+		bytes = selectCommand(db).Marshal()
+		aof.selectedDB = db
+	}
+	bytes = append(bytes, value.Marshal()...)
+	n, err := aof.file.Write(bytes)
+	aof.size += int64(n)
 	if err != nil {
 		return err
 	}
+	if aof.rewriting {
+		aof.rewriteBuf = append(aof.rewriteBuf, bytes)
+	}
+
+	if aof.fsync == FsyncAlways {
+		return syncFile(aof.file)
+	}
+	aof.dirty = true
+	return nil
+}
+
+// Read 从头回放 AOF 文件，每解析出一条完整的命令就调用一次 callback，callback 返回错误时停止回放并返回这个错误。
+// 如果文件最后一条命令不完整（例如写入过程中宕机），会返回 io.ErrUnexpectedEOF，
+// 同时返回最后一条完整命令结束处的偏移量，调用方可以据此截断文件。
+func (aof *Aof) Read(callback func(value Value) error) (int64, error) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if _, err := aof.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	aof.rd.Reset(aof.file)
+
+	counter := &countingReader{reader: aof.rd}
+	resp := NewResp(counter)
+	var offset int64
+	for {
+		value, err := resp.Read()
+		// 已经从文件读出、但还没有被解析的字节不算在内
+		consumed := counter.n - int64(resp.reader.Buffered())
+		if err != nil {
+			if err == io.EOF && consumed == offset {
+				break
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return offset, err
+		}
+		offset = consumed
+		if err := callback(value); err != nil {
+			return offset, err
+		}
+	}
+
+	// 回放结束后把写入位置移到文件末尾，后续的 Write 追加在后面
+	if _, err := aof.file.Seek(0, io.SeekEnd); err != nil {
+		return offset, err
+	}
+	aof.size, aof.baseSize = offset, offset
+	return offset, nil
+}
+
+// Truncate 把 AOF 文件截断到 size 字节，用于丢弃末尾不完整的命令
+func (aof *Aof) Truncate(size int64) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if err := aof.file.Truncate(size); err != nil {
+		return err
+	}
+	aof.size, aof.baseSize = size, size
+	_, err := aof.file.Seek(size, io.SeekStart)
+	return err
+}
+
+// aofRewriteTempPrefix 重写时临时文件的名字前缀，后面是进程号
+const aofRewriteTempPrefix = "temp-rewriteaof-bg-"
+
+// removeAofRewriteTempFiles 删除 dir 下之前的进程在重写过程中退出时留下的临时文件
+func removeAofRewriteTempFiles(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, aofRewriteTempPrefix+"*.aof"))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			logger.Warning("Failed to remove AOF rewrite temp file %s: %s", path, err.Error())
+			continue
+		}
+		logger.Info("Removed AOF rewrite temp file %s", path)
+	}
+}
+
+// errRewriteInProgress 已经有一个重写在进行
+var errRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+
+// Rewrite 根据内存中的当前数据生成一份最小的命令日志替换现有 AOF。
+// 重写期间的写入依然追加到旧文件（保证重写失败时数据不丢），同时缓存在 rewriteBuf 中，
+// 新文件写完后把缓存追加到末尾，再通过 rename 原子地替换旧文件。
+// background 为 true 时在后台 goroutine 中完成，调用立即返回。
+func (aof *Aof) Rewrite(background bool) error {
+	// 生成快照和开始缓存新的写入在 writeMu 中一起完成：
+	// 之前执行的写命令都在快照里，之后执行的都在 rewriteBuf 里，不会重复也不会遗漏
+	writeMu.Lock()
+	aof.mu.Lock()
+	if aof.rewriting {
+		aof.mu.Unlock()
+		writeMu.Unlock()
+		return errRewriteInProgress
+	}
+	aof.rewriting = true
+	aof.rewriteBuf = nil
+	// 重写后的文件末尾选择的数据库不确定，让缓存的第一条命令带上 SELECT
+	aof.selectedDB = -1
+	aof.mu.Unlock()
+	data := snapshotDatabases()
+	writeMu.Unlock()
+
+	if background {
+		go func() {
+			_ = aof.rewrite(data)
+		}()
+		return nil
+	}
+	return aof.rewrite(data)
+}
+
+func (aof *Aof) rewrite(data []map[string]*Entry) error {
+	start := time.Now()
+	err := aof.doRewrite(data)
+
+	aof.mu.Lock()
+	aof.rewriting = false
+	aof.rewriteBuf = nil
+	aof.mu.Unlock()
 
+	if err != nil {
+		logger.Error("AOF rewrite failed: %s", err.Error())
+		return err
+	}
+	logger.Info("AOF rewrite finished in %s", time.Since(start))
 	return nil
 }
+
+func (aof *Aof) doRewrite(data []map[string]*Entry) error {
+	tempPath := filepath.Join(filepath.Dir(aof.path), fmt.Sprintf("%s%d.aof", aofRewriteTempPrefix, os.Getpid()))
+	temp, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	// 出错时清理临时文件，rename 成功后 Remove 会失败，直接忽略
+	defer os.Remove(tempPath)
+
+	writer := bufio.NewWriter(temp)
+	for _, command := range memoryStoreCommands(data, time.Now()) {
+		if _, err := writer.Write(command.Marshal()); err != nil {
+			_ = temp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = temp.Close()
+		return err
+	}
+
+	// 追加重写期间的写入并替换文件，这一步需要阻塞新的写入
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.closed {
+		_ = temp.Close()
+		return errors.New("AOF closed during rewrite")
+	}
+	for _, bytes := range aof.rewriteBuf {
+		if _, err := temp.Write(bytes); err != nil {
+			_ = temp.Close()
+			return err
+		}
+	}
+	if err := temp.Sync(); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	size, err := temp.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := os.Rename(tempPath, aof.path); err != nil {
+		_ = temp.Close()
+		return err
+	}
+
+	_ = aof.file.Close()
+	aof.file = temp
+	aof.rd.Reset(temp)
+	aof.size, aof.baseSize = size, size
+	aof.dirty = false
+	return nil
+}
+
+// maybeRewrite 根据 auto-aof-rewrite-percentage 和 auto-aof-rewrite-min-size 判断是否需要自动重写
+func (aof *Aof) maybeRewrite() {
+	ConfigsMu.RLock()
+	percentage, _ := strconv.ParseInt(Configs["auto-aof-rewrite-percentage"], 10, 64)
+	minSize, _ := parseMemory(Configs["auto-aof-rewrite-min-size"])
+	ConfigsMu.RUnlock()
+	if percentage <= 0 {
+		return
+	}
+
+	aof.mu.Lock()
+	size, baseSize, rewriting := aof.size, aof.baseSize, aof.rewriting
+	aof.mu.Unlock()
+	if rewriting || size < minSize {
+		return
+	}
+	if baseSize == 0 {
+		baseSize = 1
+	}
+	growth := (size - baseSize) * 100 / baseSize
+	if growth < percentage {
+		return
+	}
+
+	logger.Info("Starting automatic rewriting of AOF on %d%% growth", growth)
+	_ = aof.Rewrite(true)
+}
+
+func selectCommand(db int) Value {
+	return Value{typ: ARRAY, array: bulks("SELECT", strconv.Itoa(db))}
+}
+
+func bulks(strs ...string) []Value {
+	values := make([]Value, 0, len(strs))
+	for _, str := range strs {
+		values = append(values, Value{typ: BULK, bulk: []byte(str)})
+	}
+	return values
+}
+
+// memoryStoreCommands 把所有数据库中的数据转换成能重建它们的最少命令，已过期的 key 不会写入
+func memoryStoreCommands(dbs []map[string]*Entry, now time.Time) []Value {
+	var commands []Value
+	for db, data := range dbs {
+		if len(data) == 0 {
+			continue
+		}
+		commands = append(commands, selectCommand(db))
+		commands = append(commands, databaseCommands(data, now)...)
+	}
+	return commands
+}
+
+func databaseCommands(data map[string]*Entry, now time.Time) []Value {
+	var commands []Value
+	for key, entry := range data {
+		if entry.expired(now) {
+			continue
+		}
+		switch value := entry.Value.(type) {
+		case []byte:
+			commands = append(commands, Value{typ: ARRAY, array: append(bulks("SET", key), Value{typ: BULK, bulk: value})})
+		case *Hash:
+			batch := rewriteBatch{name: "HSET", key: key}
+			for field, v := range value.Fields {
+				batch.add(field, string(v))
+			}
+			commands = append(commands, batch.done()...)
+		case []string:
+			batch := rewriteBatch{name: "RPUSH", key: key}
+			for _, element := range value {
+				batch.add(element)
+			}
+			commands = append(commands, batch.done()...)
+		case map[string]struct{}:
+			batch := rewriteBatch{name: "SADD", key: key}
+			for member := range value {
+				batch.add(member)
+			}
+			commands = append(commands, batch.done()...)
+		case map[string]float64:
+			batch := rewriteBatch{name: "ZADD", key: key}
+			for member, score := range value {
+				batch.add(strconv.FormatFloat(score, 'g', 17, 64), member)
+			}
+			commands = append(commands, batch.done()...)
+		default:
+			continue
+		}
+		// 过期时间使用绝对时间戳，回放时不受重写和加载之间间隔的影响
+		if (entry.ExpiryInMS != time.Time{}) {
+			when := strconv.FormatInt(entry.ExpiryInMS.UnixMilli(), 10)
+			commands = append(commands, Value{typ: ARRAY, array: bulks("PEXPIREAT", key, when)})
+		}
+	}
+	return commands
+}
+
+// aofRewriteItemsPerCmd 重写时一条命令最多包含的元素个数，和 Redis 的 AOF_REWRITE_ITEMS_PER_CMD 一致。
+// 大的容器拆成多条命令，回放时不会超过 maxMultibulkLen 的限制
+const aofRewriteItemsPerCmd = 64
+
+// rewriteBatch 把一个容器的元素拆成多条 name key item [item ...] 命令
+type rewriteBatch struct {
+	name, key string
+	commands  []Value
+	args      []Value
+	items     int
+}
+
+// add 加入一个元素，hash 的字段和值、zset 的分数和成员合起来算一个元素
+func (b *rewriteBatch) add(item ...string) {
+	if b.items == 0 {
+		b.args = bulks(b.name, b.key)
+	}
+	b.args = append(b.args, bulks(item...)...)
+	b.items++
+	if b.items == aofRewriteItemsPerCmd {
+		b.commands = append(b.commands, Value{typ: ARRAY, array: b.args})
+		b.items = 0
+	}
+}
+
+// done 返回所有的命令
+func (b *rewriteBatch) done() []Value {
+	if b.items > 0 {
+		b.commands = append(b.commands, Value{typ: ARRAY, array: b.args})
+	}
+	return b.commands
+}
+
+func bgRewriteAof(sc *ServerConnection, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'bgrewriteaof' command"}
+	}
+	if AOF == nil {
+		return Value{typ: ERROR, str: "ERR Append only file is disabled, set appendonly yes first"}
+	}
+	if err := AOF.Rewrite(true); err != nil {
+		return Value{typ: ERROR, str: "ERR " + err.Error()}
+	}
+	return Value{typ: STRING, str: "Background append only file rewriting started"}
+}
+
+// countingReader 记录从底层 reader 读出的字节数
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeMu 写命令执行和写入 AOF 的整个过程中持有，写命令因此串行执行，
+// AOF 中命令的顺序和它们修改数据的顺序一致。生成快照时也要持有，快照不会包含执行到一半的写命令
+var writeMu sync.Mutex
+
+// WriteCommands 需要写入 AOF 的命令
+var WriteCommands = map[string]bool{
+	"SET":      true,
+	"SETNX":    true,
+	"SETEX":    true,
+	"PSETEX":   true,
+	"GETSET":   true,
+	"GETDEL":   true,
+	"GETEX":    true,
+	"HSET":     true,
+	"RPUSH":    true,
+	"SADD":     true,
+	"ZADD":     true,
+	"MOVE":     true,
+	"SWAPDB":   true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+	"DEL":      true,
+	"UNLINK":   true,
+	"RENAME":   true,
+	"RENAMENX": true,
+	"COPY":     true,
+
+	"EXPIRE":    true,
+	"PEXPIRE":   true,
+	"EXPIREAT":  true,
+	"PEXPIREAT": true,
+	"PERSIST":   true,
+}
+
+func aofPath() string {
+	ConfigsMu.RLock()
+	defer ConfigsMu.RUnlock()
+	return filepath.Join(Configs["dir"], Configs["appendfilename"])
+}
+
+func aofEnabled() bool {
+	ConfigsMu.RLock()
+	defer ConfigsMu.RUnlock()
+	return Configs["appendonly"] == "yes"
+}
+
+// loadAofFileIntoKVMemoryStore 打开 AOF 文件并回放其中的写命令，必须在开始接受客户端连接之前调用
+func loadAofFileIntoKVMemoryStore() error {
+	path := aofPath()
+	ConfigsMu.RLock()
+	fsync := Configs["appendfsync"]
+	ConfigsMu.RUnlock()
+	aof, err := NewAof(path, fsync)
+	if err != nil {
+		return err
+	}
+
+	// 回放使用一个虚拟连接，AOF 中的 SELECT 会切换它的数据库
+	replay := &ServerConnection{}
+	count := 0
+	offset, err := aof.Read(func(value Value) error {
+		if value.typ != ARRAY || len(value.array) == 0 {
+			return nil
+		}
+		command := strings.ToUpper(string(value.array[0].bulk))
+		handle, ok := Handlers[command]
+		if !ok {
+			logger.Warning("unknown command in AOF: " + command)
+			return nil
+		}
+		result := handle(replay, value.array[1:])
+		// SELECT 失败时后面的命令会被回放到错误的数据库里，不能继续
+		if command == "SELECT" && result.typ == ERROR {
+			return errors.New("SELECT in AOF failed: " + result.str)
+		}
+		count++
+		return nil
+	})
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		ConfigsMu.RLock()
+		loadTruncated := Configs["aof-load-truncated"] == "yes"
+		ConfigsMu.RUnlock()
+		if !loadTruncated {
+			_ = aof.Close()
+			return errors.New("AOF file " + path + " is truncated, set aof-load-truncated yes to load it anyway")
+		}
+		logger.Warning("AOF file %s is truncated, discarding the last incomplete command at offset %d", path, offset)
+		err = aof.Truncate(offset)
+	}
+	if err != nil {
+		_ = aof.Close()
+		return err
+	}
+
+	logger.Info("AOF loaded %d commands from %s", count, path)
+	AOF = aof
+	return nil
+}
+
+func fileNotEmpty(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > 0
+}
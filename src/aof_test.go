@@ -0,0 +1,514 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useAofDir 把 AOF 文件放到临时目录，并在测试结束后关闭全局 AOF
+func useAofDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	setConfig(t, "dir", dir)
+	setConfig(t, "appendfilename", "appendonly.aof")
+	setConfig(t, "appendfsync", FsyncEverySec)
+	t.Cleanup(func() {
+		if AOF != nil {
+			_ = AOF.Close()
+			AOF = nil
+		}
+		resetStore()
+	})
+	return filepath.Join(dir, "appendonly.aof")
+}
+
+func writeAofFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAofReplay(t *testing.T) {
+	path := useAofDir(t)
+	aof, err := NewAof(path, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []Value{
+		command("SET", "k", "v1"),
+		command("HSET", "h", "f1", "a", "f2", "b"),
+		command("SET", "k", "v2"),
+	} {
+		if err := aof.Write(0, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = aof.Close()
+
+	resetStore()
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := text(call("GET", "k")); got != "v2" {
+		t.Errorf("GET k = %q, want %q", got, "v2")
+	}
+	if got := text(call("HGET", "h", "f2")); got != "b" {
+		t.Errorf("HGET h f2 = %q, want %q", got, "b")
+	}
+
+	// 回放之后的写入追加在文件末尾
+	if err := AOF.Write(0, command("SET", "k2", "v3")); err != nil {
+		t.Fatal(err)
+	}
+	_ = AOF.Close()
+	AOF = nil
+	resetStore()
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := text(call("GET", "k")); got != "v2" {
+		t.Errorf("GET k after reload = %q, want %q", got, "v2")
+	}
+	if got := text(call("GET", "k2")); got != "v3" {
+		t.Errorf("GET k2 after reload = %q, want %q", got, "v3")
+	}
+}
+
+func TestAofLoadTruncated(t *testing.T) {
+	complete := command("SET", "a", "1").Marshal()
+	partial := []byte("*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1")
+
+	t.Run("yes", func(t *testing.T) {
+		path := useAofDir(t)
+		setConfig(t, "aof-load-truncated", "yes")
+		writeAofFile(t, path, append(append([]byte{}, complete...), partial...))
+
+		if err := loadAofFileIntoKVMemoryStore(); err != nil {
+			t.Fatal(err)
+		}
+		if got := text(call("GET", "a")); got != "1" {
+			t.Errorf("GET a = %q, want %q", got, "1")
+		}
+		if got := call("GET", "b"); got.typ != NULL {
+			t.Errorf("GET b = %+v, want NULL", got)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(complete)) {
+			t.Errorf("AOF size after load = %d, want %d", info.Size(), len(complete))
+		}
+	})
+
+	t.Run("no", func(t *testing.T) {
+		path := useAofDir(t)
+		setConfig(t, "aof-load-truncated", "no")
+		writeAofFile(t, path, append(append([]byte{}, complete...), partial...))
+
+		if err := loadAofFileIntoKVMemoryStore(); err == nil {
+			t.Fatal("loading a truncated AOF succeeded with aof-load-truncated no")
+		}
+		if AOF != nil {
+			t.Error("AOF is set after a failed load")
+		}
+	})
+}
+
+// isDirty 在锁内读取 dirty，避免和后台 fsync goroutine 竞争
+func isDirty(aof *Aof) bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return aof.dirty
+}
+
+func TestAofFsyncPolicy(t *testing.T) {
+	path := useAofDir(t)
+	if _, err := NewAof(path, "sometimes"); err == nil {
+		t.Fatal("NewAof accepted an invalid appendfsync policy")
+	}
+
+	aof, err := NewAof(path, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Write(0, command("SET", "k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if !isDirty(aof) {
+		t.Error("everysec write did not mark the AOF dirty")
+	}
+	if err := aof.SetFsyncPolicy("sometimes"); err == nil {
+		t.Error("SetFsyncPolicy accepted an invalid policy")
+	}
+	// 切换到 always 时立即把已写入的数据刷盘
+	if err := aof.SetFsyncPolicy(FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	if isDirty(aof) {
+		t.Error("switching to always left the AOF dirty")
+	}
+	if err := aof.Write(0, command("SET", "k", "v2")); err != nil {
+		t.Fatal(err)
+	}
+	if isDirty(aof) {
+		t.Error("always write left the AOF dirty")
+	}
+
+	// Close 等待后台 fsync goroutine 退出
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-aof.done:
+	default:
+		t.Error("syncer is still running after Close")
+	}
+}
+
+func TestConfigSetAppendFsync(t *testing.T) {
+	useAofDir(t)
+	setConfig(t, "appendfsync", FsyncEverySec)
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := call("CONFIG", "SET", "appendfsync", "sometimes"); got.typ != ERROR {
+		t.Errorf("CONFIG SET appendfsync sometimes = %+v, want an error", got)
+	}
+	if got := call("CONFIG", "SET", "appendfsync", FsyncNo); text(got) != "OK" {
+		t.Fatalf("CONFIG SET appendfsync no = %+v", got)
+	}
+	if AOF.fsync != FsyncNo {
+		t.Errorf("AOF fsync policy = %q, want %q", AOF.fsync, FsyncNo)
+	}
+	if got := text(call("CONFIG", "GET", "appendfsync").array[1]); got != FsyncNo {
+		t.Errorf("CONFIG GET appendfsync = %q, want %q", got, FsyncNo)
+	}
+}
+
+// callAndLog 执行一条写命令并追加到 AOF，和客户端写入的效果相同
+func callAndLog(t *testing.T, args ...string) {
+	t.Helper()
+	call(args...)
+	if err := AOF.Write(0, command(args...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAofRewriteReload(t *testing.T) {
+	path := useAofDir(t)
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	// 同一个 key 反复写入，重写后只应保留最后一次
+	for i := 0; i < 100; i++ {
+		callAndLog(t, "SET", "counter", strconv.Itoa(i))
+	}
+	callAndLog(t, "SET", "ttl", "v", "PX", "100000")
+	callAndLog(t, "SET", "gone", "v", "PX", "1")
+	callAndLog(t, "HSET", "h", "f1", "a", "f2", "b")
+	callAndLog(t, "RPUSH", "list", "a", "b")
+	callAndLog(t, "RPUSH", "list", "c")
+	callAndLog(t, "SADD", "set", "a", "b", "a")
+	callAndLog(t, "ZADD", "zset", "1", "a", "2", "b")
+	callAndLog(t, "ZADD", "zset", "3", "a")
+	time.Sleep(5 * time.Millisecond)
+
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AOF.Rewrite(false); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("AOF size after rewrite = %d, want less than %d", after.Size(), before.Size())
+	}
+
+	_ = AOF.Close()
+	AOF = nil
+	resetStore()
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := text(call("GET", "counter")); got != "99" {
+		t.Errorf("GET counter = %q, want %q", got, "99")
+	}
+	if got := text(call("GET", "ttl")); got != "v" {
+		t.Errorf("GET ttl = %q, want %q", got, "v")
+	}
+	entry, gone := lookupEntry("ttl"), lookupEntry("gone") != nil
+	if entry == nil || (entry.ExpiryInMS == time.Time{}) {
+		t.Error("key ttl lost its expiry across the rewrite")
+	}
+	if gone {
+		t.Error("expired key was written by the rewrite")
+	}
+	if got := text(call("HGET", "h", "f1")); got != "a" {
+		t.Errorf("HGET h f1 = %q, want %q", got, "a")
+	}
+	for key, want := range map[string]any{
+		"list": []string{"a", "b", "c"},
+		"set":  map[string]struct{}{"a": {}, "b": {}},
+		"zset": map[string]float64{"a": 3, "b": 2},
+	} {
+		if entry := lookupEntry(key); entry == nil || !reflect.DeepEqual(entry.Value, want) {
+			t.Errorf("key %q after rewrite and reload = %+v, want %v", key, entry, want)
+		}
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		err   bool
+	}{
+		{"1024", 1024, false},
+		{"64mb", 64 << 20, false},
+		{"1GB", 1 << 30, false},
+		{"2k", 2000, false},
+		{"10b", 10, false},
+		{"-1", 0, true},
+		{"mb", 0, true},
+		{"1tb", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMemory(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d, error %v", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestAofReplayDatabases(t *testing.T) {
+	useAofDir(t)
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	sc := &ServerConnection{}
+	for _, args := range [][]string{
+		{"SET", "k", "db0"},
+		{"SELECT", "2"},
+		{"SET", "k", "db2"},
+		{"SET", "gone", "v"},
+		{"MOVE", "gone", "5"},
+		{"SWAPDB", "2", "3"},
+	} {
+		callOn(sc, args...)
+		if WriteCommands[args[0]] {
+			if err := AOF.Write(sc.db, command(args...)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(stage string) {
+		t.Helper()
+		for _, tt := range []struct {
+			db        int
+			key, want string
+		}{
+			{0, "k", "db0"},
+			{3, "k", "db2"},
+			{5, "gone", "v"},
+		} {
+			if entry := lookupEntryIn(tt.db, tt.key); entry == nil || string(entry.Value.([]byte)) != tt.want {
+				t.Errorf("%s: db %d key %q = %+v, want %q", stage, tt.db, tt.key, entry, tt.want)
+			}
+		}
+		if lookupEntryIn(2, "k") != nil {
+			t.Errorf("%s: db 2 still has key k after SWAPDB", stage)
+		}
+	}
+
+	reload := func() {
+		t.Helper()
+		_ = AOF.Close()
+		AOF = nil
+		resetStore()
+		if err := loadAofFileIntoKVMemoryStore(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload()
+	check("replay")
+	if err := AOF.Rewrite(false); err != nil {
+		t.Fatal(err)
+	}
+	reload()
+	check("rewrite")
+}
+
+func TestAofConcurrentWrites(t *testing.T) {
+	useAofDir(t)
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 多个连接同时写入同一个列表，中途开始后台重写。
+	// 回放 AOF 得到的列表必须和内存中的顺序完全一致
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			sc := &ServerConnection{}
+			for i := 0; i < 100; i++ {
+				value := command("RPUSH", "list", strconv.Itoa(c*1000+i))
+				sc.execute("RPUSH", Handlers["RPUSH"], value)
+				if c == 0 && i == 50 {
+					if err := AOF.Rewrite(true); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	for i := 0; i < 500; i++ {
+		AOF.mu.Lock()
+		rewriting := AOF.rewriting
+		AOF.mu.Unlock()
+		if !rewriting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := lookupEntry("list").Value.([]string)
+
+	_ = AOF.Close()
+	AOF = nil
+	resetStore()
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	if entry := lookupEntry("list"); entry == nil || !reflect.DeepEqual(entry.Value, want) {
+		t.Errorf("list after reload = %+v, want the %d items in memory in the same order", entry, len(want))
+	}
+}
+
+func TestDatabaseCommandsBatches(t *testing.T) {
+	list := make([]string, 130)
+	hash := newHash(0)
+	for i := range list {
+		list[i] = strconv.Itoa(i)
+		hash.set("f"+strconv.Itoa(i), []byte("v"))
+	}
+	data := map[string]*Entry{
+		"list": {Type: TypeList, Value: list},
+		"hash": {Type: TypeHash, Value: hash},
+	}
+	counts := map[string][]int{}
+	for _, cmd := range databaseCommands(data, time.Now()) {
+		name := string(cmd.array[0].bulk)
+		counts[name] = append(counts[name], len(cmd.array)-2)
+	}
+	// 130 个元素拆成 64、64、2，hash 的每个元素是字段和值两个参数
+	if want := []int{64, 64, 2}; !reflect.DeepEqual(counts["RPUSH"], want) {
+		t.Errorf("RPUSH argument counts = %v, want %v", counts["RPUSH"], want)
+	}
+	if want := []int{128, 128, 4}; !reflect.DeepEqual(counts["HSET"], want) {
+		t.Errorf("HSET argument counts = %v, want %v", counts["HSET"], want)
+	}
+}
+
+func TestRemoveAofRewriteTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"temp-rewriteaof-bg-123.aof", "temp-rewriteaof-bg-456.aof", "appendonly.aof"} {
+		writeAofFile(t, filepath.Join(dir, name), []byte("x"))
+	}
+	removeAofRewriteTempFiles(dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "appendonly.aof" {
+		t.Errorf("files left = %v, want only appendonly.aof", entries)
+	}
+}
+
+func TestAofBadSelect(t *testing.T) {
+	path := useAofDir(t)
+	var data []byte
+	for _, args := range [][]string{
+		{"SET", "k", "db0"},
+		{"SELECT", "99"},
+		{"SET", "k", "lost"},
+	} {
+		data = append(data, command(args...).Marshal()...)
+	}
+	writeAofFile(t, path, data)
+
+	// SELECT 失败之后的命令会写进错误的数据库，加载直接失败
+	err := loadAofFileIntoKVMemoryStore()
+	if err == nil || !strings.Contains(err.Error(), "SELECT") {
+		t.Fatalf("loadAofFileIntoKVMemoryStore() = %v, want a SELECT error", err)
+	}
+	if got := text(call("GET", "k")); got == "lost" {
+		t.Error("command after a failed SELECT was replayed into db 0")
+	}
+}
+
+func TestMovePropagation(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	sc := &ServerConnection{}
+	callOn(sc, "SET", "k", "v")
+	callOn(&ServerConnection{db: 1}, "SET", "k", "other")
+	for _, key := range []string{"missing", "k"} {
+		sc.aofCommand = nil
+		if got := callOn(sc, "MOVE", key, "1"); got.num != 0 {
+			t.Fatalf("MOVE %s 1 = %+v, want 0", key, got)
+		}
+		if sc.aofCommand == nil || len(sc.aofCommand.array) != 0 {
+			t.Errorf("MOVE %s that changed nothing propagated as %+v", key, sc.aofCommand)
+		}
+	}
+}
+
+func TestAofSyncDuringRewrite(t *testing.T) {
+	useAofDir(t)
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 后台每秒一次的 fsync 和重写替换文件同时进行，用 -race 运行时不能有数据竞争
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := AOF.Write(0, command("SET", "k", strconv.Itoa(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for deadline := time.Now().Add(1500 * time.Millisecond); time.Now().Before(deadline); {
+		if err := AOF.Rewrite(false); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// nextClientID 连接编号，从 1 开始递增，不会重复使用
+var nextClientID atomic.Int64
+
+func client(sc *ServerConnection, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'client' command"}
+	}
+	cmd := string(args[0].bulk)
+	switch strings.ToUpper(cmd) {
+	case "ID":
+		if len(args) != 1 {
+			return Value{typ: ERROR, str: "ERR wrong number of arguments for 'client|id' command"}
+		}
+		return Value{typ: INTEGER, num: int(sc.id)}
+	case "INFO":
+		if len(args) != 1 {
+			return Value{typ: ERROR, str: "ERR wrong number of arguments for 'client|info' command"}
+		}
+		return Value{typ: VERBATIM, bulk: []byte(sc.info() + "\n")}
+	default:
+		return Value{typ: ERROR, str: "ERR unknown subcommand '" + cmd + "'"}
+	}
+}
+
+// info CLIENT INFO 的内容。TLS 连接额外输出协商的版本和客户端证书的 subject，没有客户端证书时 subject 为空
+func (sc *ServerConnection) info() string {
+	fields := []string{
+		fmt.Sprintf("id=%d", sc.id),
+		"addr=" + sc.con.RemoteAddr().String(),
+		"laddr=" + sc.con.LocalAddr().String(),
+		"name=" + sc.name,
+		fmt.Sprintf("db=%d", sc.db),
+		fmt.Sprintf("resp=%d", sc.proto),
+	}
+	if tlsConn, ok := sc.con.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		subject := ""
+		if len(state.PeerCertificates) > 0 {
+			subject = state.PeerCertificates[0].Subject.String()
+		}
+		fields = append(fields,
+			"tls-version="+tlsVersionName(state.Version),
+			"tls-client-subject="+strings.ReplaceAll(subject, " ", "\\x20"),
+		)
+	}
+	return strings.Join(fields, " ")
+}
+
+// hello HELLO [protover [AUTH username password] [SETNAME clientname]]，
+// 切换连接使用的协议版本，回复服务端的信息，回复本身已经使用新的协议版本编码。
+// 服务端没有配置密码，default 用户使用任意密码都可以认证成功
+func hello(sc *ServerConnection, args []Value) Value {
+	proto, name, setName := sc.proto, "", false
+	if len(args) > 0 {
+		version, err := strconv.Atoi(string(args[0].bulk))
+		if err != nil {
+			return Value{typ: ERROR, str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if version != 2 && version != 3 {
+			return Value{typ: ERROR, str: "NOPROTO unsupported protocol version"}
+		}
+		proto = version
+
+		for i := 1; i < len(args); i++ {
+			option := strings.ToUpper(string(args[i].bulk))
+			switch {
+			case option == "AUTH" && i+2 < len(args):
+				if string(args[i+1].bulk) != "default" {
+					return Value{typ: ERROR, str: "WRONGPASS invalid username-password pair or user is disabled."}
+				}
+				i += 2
+			case option == "SETNAME" && i+1 < len(args):
+				name, setName = string(args[i+1].bulk), true
+				if !validClientName(name) {
+					return Value{typ: ERROR, str: "ERR Client names cannot contain spaces, newlines or special characters."}
+				}
+				i++
+			default:
+				return Value{typ: ERROR, str: "ERR Syntax error in HELLO option '" + string(args[i].bulk) + "'"}
+			}
+		}
+	}
+
+	sc.proto = proto
+	if setName {
+		sc.name = name
+	}
+	return Value{typ: MAP, array: []Value{
+		{typ: BULK, bulk: []byte("server")}, {typ: BULK, bulk: []byte("redis")},
+		{typ: BULK, bulk: []byte("version")}, {typ: BULK, bulk: []byte(redisVersion)},
+		{typ: BULK, bulk: []byte("proto")}, {typ: INTEGER, num: proto},
+		{typ: BULK, bulk: []byte("id")}, {typ: INTEGER, num: int(sc.id)},
+		{typ: BULK, bulk: []byte("mode")}, {typ: BULK, bulk: []byte("standalone")},
+		{typ: BULK, bulk: []byte("role")}, {typ: BULK, bulk: []byte("master")},
+		{typ: BULK, bulk: []byte("modules")}, {typ: ARRAY, array: []Value{}},
+	}}
+}
+
+// validClientName 连接名称只能包含空格以外的可见 ASCII 字符
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,16 +1,42 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"my-redis-go/logging"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-var port = flag.String("port", "6379", "port to listen on")
+var port = flag.String("port", "6379", "port to listen on, 0 picks a free port, empty disables TCP")
+var bind = flag.String("bind", "", "Space separated addresses to listen on, empty listens on all addresses")
+var unixSocket = flag.String("unixsocket", "", "Path of the Unix socket to listen on, empty disables it")
+var unixSocketPerm = flag.String("unixsocketperm", "0", "Octal permissions of the Unix socket file, 0 keeps the default")
+var tlsPort = flag.String("tls-port", "", "TLS port to listen on, 0 picks a free port, empty disables TLS")
+var tlsCertFile = flag.String("tls-cert-file", "", "Server certificate file in PEM format")
+var tlsKeyFile = flag.String("tls-key-file", "", "Private key file of the server certificate in PEM format")
+var tlsCaCertFile = flag.String("tls-ca-cert-file", "", "CA certificate file used to verify client certificates")
+var tlsAuthClients = flag.String("tls-auth-clients", TlsAuthClientsYes, "Require client certificates: yes, no or optional")
+var protoMaxBulkLenStr = flag.String("proto-max-bulk-len", "512mb", "Maximum size of a single bulk string in a request")
+var shutdownTimeout = flag.Int("shutdown-timeout", 10, "Seconds to wait for running commands to finish on shutdown")
+var maxClientsNum = flag.Int("maxclients", 10000, "Maximum number of connected clients")
+var idleTimeout = flag.Int("timeout", 0, "Close a client after it is idle for this many seconds, 0 disables")
+var tcpKeepAliveSec = flag.Int("tcp-keepalive", 300, "TCP keepalive period in seconds for client connections, 0 disables")
 var dir = flag.String("dir", "", "Directory to store RDB file")
 var dbFileName = flag.String("dbfilename", "dump.rdb", "RDB file name")
+var databasesNum = flag.Int("databases", 16, "Number of databases, selected with SELECT <dbid>")
+var saveParams = flag.String("save", "3600 1 300 100 60 10000", "Snapshot rules as <seconds> <changes> pairs, empty disables automatic snapshots")
+var rdbChecksum = flag.String("rdbchecksum", "yes", "Write and verify the CRC64 checksum at the end of RDB files: yes or no")
+var rdbLoadCorrupt = flag.String("rdb-load-corrupt", RdbCorruptExit, "What to do when the RDB file is corrupt on startup: exit, or rename it aside and start empty")
+var appendOnly = flag.String("appendonly", "no", "Enable the append only file: yes or no")
+var appendFileName = flag.String("appendfilename", "appendonly.aof", "AOF file name")
+var appendFsync = flag.String("appendfsync", FsyncEverySec, "AOF fsync policy: always, everysec or no")
+var autoAofRewritePercentage = flag.String("auto-aof-rewrite-percentage", "100", "Rewrite the AOF when it grows by this percentage since the last rewrite, 0 disables")
+var autoAofRewriteMinSize = flag.String("auto-aof-rewrite-min-size", "64mb", "Minimum AOF size before an automatic rewrite is triggered")
+var aofLoadTruncated = flag.String("aof-load-truncated", "yes", "Load a truncated AOF by discarding the last incomplete command: yes or no")
 
 // var logLevelStr = flag.String("loglevel", "INFO", "log print level")
 var logLevel = flag.Int64("loglevel", 1, "log print level: 0 debug 1 info 2 warning 3 error 4 fatal 5 off")
@@ -24,22 +50,268 @@ func initConfigs() {
 	flag.Parse()
 
 	logger = *logging.New(int(*logLevel))
+	if _, err := parseSaveRules(*saveParams); err != nil {
+		logger.Fatal("Invalid save parameters: %s", *saveParams)
+	}
+	if n, err := strconv.Atoi(*port); *port != "" && (err != nil || n < 0 || n > 65535) {
+		logger.Fatal("Invalid port: %s", *port)
+	}
+	if _, err := strconv.ParseUint(*unixSocketPerm, 8, 32); err != nil {
+		logger.Fatal("Invalid unixsocketperm: %s", *unixSocketPerm)
+	}
+	if n, err := strconv.Atoi(*tlsPort); *tlsPort != "" && (err != nil || n < 0 || n > 65535) {
+		logger.Fatal("Invalid tls-port: %s", *tlsPort)
+	}
+	if *port == "" && *unixSocket == "" && *tlsPort == "" {
+		logger.Fatal("Nothing to listen on: port is empty and unixsocket is not set")
+	}
+	if err := setProtoMaxBulkLen(*protoMaxBulkLenStr); err != nil {
+		logger.Fatal("Invalid proto-max-bulk-len: %s", *protoMaxBulkLenStr)
+	}
+	if *shutdownTimeout < 0 {
+		logger.Fatal("Invalid shutdown-timeout: %d", *shutdownTimeout)
+	}
+	if *maxClientsNum < 1 {
+		logger.Fatal("Invalid maxclients: %d", *maxClientsNum)
+	}
+	if *idleTimeout < 0 {
+		logger.Fatal("Invalid timeout: %d", *idleTimeout)
+	}
+	if *tcpKeepAliveSec < 0 {
+		logger.Fatal("Invalid tcp-keepalive: %d", *tcpKeepAliveSec)
+	}
+	if limit, ok := openFileLimit(); ok {
+		if capped := capMaxClients(int64(*maxClientsNum), limit); capped != int64(*maxClientsNum) {
+			if capped < 1 {
+				logger.Fatal("The open file limit of %d is not enough for the server to start, at least %d is needed", limit, reservedFDs+1)
+			}
+			logger.Warning("maxclients of %d needs at least %d file descriptors, but the open file limit is %d, maxclients has been reduced to %d",
+				*maxClientsNum, int64(*maxClientsNum)+reservedFDs, limit, capped)
+			*maxClientsNum = int(capped)
+		}
+	}
+	maxClients.Store(int64(*maxClientsNum))
+	clientIdleTimeout.Store(int64(*idleTimeout))
+	tcpKeepAlive.Store(int64(*tcpKeepAliveSec))
+	if *databasesNum < 1 {
+		logger.Fatal("Invalid number of databases: %d", *databasesNum)
+	}
+	initDatabases(*databasesNum)
+	if !validYesNo(*rdbChecksum) {
+		logger.Fatal("Invalid rdbchecksum: %s, must be yes or no", *rdbChecksum)
+	}
+	if *rdbLoadCorrupt != RdbCorruptExit && *rdbLoadCorrupt != RdbCorruptRename {
+		logger.Fatal("Invalid rdb-load-corrupt: %s, must be exit or rename", *rdbLoadCorrupt)
+	}
+	if !validYesNo(*appendOnly) {
+		logger.Fatal("Invalid appendonly: %s, must be yes or no", *appendOnly)
+	}
+	if !validFsyncPolicy(*appendFsync) {
+		logger.Fatal("Invalid appendfsync: %s, must be always, everysec or no", *appendFsync)
+	}
+	if !validYesNo(*aofLoadTruncated) {
+		logger.Fatal("Invalid aof-load-truncated: %s, must be yes or no", *aofLoadTruncated)
+	}
 	Configs["loglevel"] = strconv.FormatInt(*logLevel, 10)
 
 	Configs["port"] = *port
+	Configs["bind"] = *bind
+	Configs["unixsocket"] = *unixSocket
+	Configs["unixsocketperm"] = *unixSocketPerm
+	Configs["tls-port"] = *tlsPort
+	Configs["tls-cert-file"] = *tlsCertFile
+	Configs["tls-key-file"] = *tlsKeyFile
+	Configs["tls-ca-cert-file"] = *tlsCaCertFile
+	Configs["tls-auth-clients"] = *tlsAuthClients
+	Configs["proto-max-bulk-len"] = *protoMaxBulkLenStr
+	Configs["shutdown-timeout"] = strconv.Itoa(*shutdownTimeout)
+	Configs["maxclients"] = strconv.Itoa(*maxClientsNum)
+	Configs["timeout"] = strconv.Itoa(*idleTimeout)
+	Configs["tcp-keepalive"] = strconv.Itoa(*tcpKeepAliveSec)
 	Configs["dir"] = *dir
 	Configs["dbfilename"] = *dbFileName
+	Configs["databases"] = strconv.Itoa(*databasesNum)
+	Configs["save"] = *saveParams
+	Configs["rdbchecksum"] = *rdbChecksum
+	Configs["rdb-load-corrupt"] = *rdbLoadCorrupt
+	Configs["appendonly"] = *appendOnly
+	Configs["appendfilename"] = *appendFileName
+	Configs["appendfsync"] = *appendFsync
+	Configs["aof-load-truncated"] = *aofLoadTruncated
+	Configs["auto-aof-rewrite-percentage"] = *autoAofRewritePercentage
+	Configs["auto-aof-rewrite-min-size"] = *autoAofRewriteMinSize
+
+	if tlsEnabled() {
+		if err := reloadTLS(currentTLSSettings()); err != nil {
+			logger.Fatal("Failed to configure TLS: %s", err.Error())
+		}
+	}
+}
+
+// reservedFDs 为监听的 socket、AOF、RDB 和日志等文件保留的文件描述符，和 Redis 的 CONFIG_MIN_RESERVED_FDS 一致
+const reservedFDs = 32
+
+// capMaxClients 进程能打开的文件描述符数量 limit 不够 maxclients 个连接使用时，返回 limit 允许的最大连接数，
+// 结果可能小于 1
+func capMaxClients(maxclients int64, limit uint64) int64 {
+	if limit >= uint64(maxclients)+reservedFDs {
+		return maxclients
+	}
+	return int64(limit) - reservedFDs
+}
+
+// validYesNo 布尔类型的配置项只接受 yes 和 no
+func validYesNo(value string) bool {
+	return value == "yes" || value == "no"
+}
+
+// configSetters 可以通过 CONFIG SET 在运行时修改的配置项，返回 error 表示值不合法
+var configSetters = map[string]func(value string) error{
+	"save": func(value string) error {
+		_, err := parseSaveRules(value)
+		return err
+	},
+	"rdbchecksum": func(value string) error {
+		if !validYesNo(value) {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		return nil
+	},
+	"appendfsync": func(value string) error {
+		if !validFsyncPolicy(value) {
+			return errors.New("argument must be one of: always, everysec, no")
+		}
+		if AOF != nil {
+			return AOF.SetFsyncPolicy(value)
+		}
+		return nil
+	},
+	"auto-aof-rewrite-percentage": func(value string) error {
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+			return errors.New("argument must be a non-negative integer")
+		}
+		return nil
+	},
+	"auto-aof-rewrite-min-size": func(value string) error {
+		_, err := parseMemory(value)
+		return err
+	},
+	"proto-max-bulk-len": setProtoMaxBulkLen,
+	"timeout":            intConfigSetter(&clientIdleTimeout, 0),
+	"tcp-keepalive":      intConfigSetter(&tcpKeepAlive, 0),
+	"maxclients": func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			return errors.New("argument must be an integer not less than 1")
+		}
+		if limit, ok := openFileLimit(); ok && capMaxClients(n, limit) != n {
+			return fmt.Errorf("the open file limit of %d does not allow %d clients", limit, n)
+		}
+		maxClients.Store(n)
+		return nil
+	},
+	"shutdown-timeout": func(value string) error {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return errors.New("argument must be a non-negative integer")
+		}
+		return nil
+	},
+	"tls-cert-file":    tlsConfigSetter("tls-cert-file"),
+	"tls-key-file":     tlsConfigSetter("tls-key-file"),
+	"tls-ca-cert-file": tlsConfigSetter("tls-ca-cert-file"),
+	"tls-auth-clients": tlsConfigSetter("tls-auth-clients"),
+}
+
+// intConfigSetter 整数配置项，值不能小于 minimum，修改后写入 target
+func intConfigSetter(target *atomic.Int64, minimum int64) func(value string) error {
+	return func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < minimum {
+			return fmt.Errorf("argument must be an integer not less than %d", minimum)
+		}
+		target.Store(n)
+		return nil
+	}
+}
+
+// setProtoMaxBulkLen 和 Redis 一样，proto-max-bulk-len 不能小于 1mb
+func setProtoMaxBulkLen(value string) error {
+	n, err := parseMemory(value)
+	if err != nil {
+		return err
+	}
+	if n < 1<<20 {
+		return errors.New("argument must be at least 1mb")
+	}
+	protoMaxBulkLen.Store(n)
+	return nil
+}
+
+// parseMemory 解析 64mb、1gb、1024 这样的内存大小，单位不区分大小写
+func parseMemory(value string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(value))
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * scale, nil
+}
+
+func config(sc *ServerConnection, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'config' command"}
+	}
+	cmd := string(args[0].bulk)
+	switch strings.ToUpper(cmd) {
+	case "GET":
+		return configGet(args)
+	case "SET":
+		return configSet(args)
+	default:
+		return Value{typ: ERROR, str: "ERR unknown subcommand '" + cmd + "'"}
+	}
+}
+
+func configSet(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'config set' command"}
+	}
+	key := strings.ToLower(string(args[1].bulk))
+	value := string(args[2].bulk)
+	setter, ok := configSetters[key]
+	if !ok {
+		return Value{typ: ERROR, str: "ERR Unknown option or number of arguments for CONFIG SET - '" + key + "'"}
+	}
+
+	ConfigsMu.Lock()
+	defer ConfigsMu.Unlock()
+	if err := setter(value); err != nil {
+		return Value{typ: ERROR, str: "ERR CONFIG SET failed (possibly related to argument '" + key + "') - " + err.Error()}
+	}
+	Configs[key] = value
+	return Value{typ: STRING, str: "OK"}
 }
 
 func configGet(args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'config get' command"}
 	}
-	cmd := args[0].bulk
-	if strings.ToUpper(cmd) != "GET" {
-		return Value{typ: ERROR, str: "ERR unknown command '" + cmd + "'"}
-	}
-	key := args[1].bulk
+	key := string(args[1].bulk)
 	ConfigsMu.RLock()
 	value, ok := Configs[key]
 	defer ConfigsMu.RUnlock()
@@ -47,7 +319,7 @@ func configGet(args []Value) Value {
 		return Value{typ: NULL}
 	}
 	var values []Value
-	values = append(values, Value{typ: BULK, bulk: key})
-	values = append(values, Value{typ: BULK, bulk: value})
-	return Value{typ: ARRAY, array: values}
+	values = append(values, Value{typ: BULK, bulk: []byte(key)})
+	values = append(values, Value{typ: BULK, bulk: []byte(value)})
+	return Value{typ: MAP, array: values}
 }
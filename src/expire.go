@@ -0,0 +1,289 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 主动过期的参数，和 Redis 的 activeExpireCycle 一致
+const (
+	activeExpireInterval   = 100 * time.Millisecond // 每秒执行 10 次
+	activeExpireKeysPerRun = 20                     // 每轮抽样的 key 数
+	activeExpireStalePerc  = 25                     // 一轮中过期的 key 超过这个比例时继续抽样
+	activeExpireTimeBudget = activeExpireInterval * 25 / 100
+)
+
+// activeExpireCycle 主动删除过期的 key。每个数据库从 Expires 中随机抽样 20 个 key，删除其中已经过期的，
+// 过期的超过 25% 说明还有很多过期的 key，继续抽样，否则换下一个数据库。
+// 每次执行最多占用 activeExpireTimeBudget，没处理完的数据库下次从这里继续
+func activeExpireCycle(start int) (next int) {
+	deadline := time.Now().Add(activeExpireTimeBudget)
+	for i := 0; i < len(databases); i++ {
+		index := (start + i) % len(databases)
+		for {
+			sampled, expired := databases[index].expireSample(activeExpireKeysPerRun)
+			if sampled == 0 || expired*100 <= sampled*activeExpireStalePerc {
+				break
+			}
+			if time.Now().After(deadline) {
+				return index
+			}
+		}
+	}
+	return start
+}
+
+// expireSample 从 Expires 中抽样最多 n 个 key，删除已经过期的，返回抽样数和删除数。
+// map 的遍历从随机的位置开始，取前 n 个就相当于随机抽样。每轮只短暂地持有写锁
+func (s *STORAGE) expireSample(n int) (sampled, expired int) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	now := time.Now()
+	for key := range s.Expires {
+		if sampled == n {
+			break
+		}
+		sampled++
+		entry, ok := s.Data[key]
+		if !ok || entry.expired(now) {
+			logger.Debug("expired key: %s", key)
+			s.remove(key)
+			dirty.Add(1)
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+// expireFlags EXPIRE 系列命令的 NX|XX|GT|LT 参数
+type expireFlags struct {
+	nx, xx, gt, lt bool
+}
+
+// parseExpireFlags 解析 NX|XX|GT|LT，NX 不能和其它参数同时使用，GT 和 LT 不能同时使用
+func parseExpireFlags(args []Value) (expireFlags, *Value) {
+	var flags expireFlags
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg.bulk)) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		default:
+			return flags, &Value{typ: ERROR, str: "ERR Unsupported option " + string(arg.bulk)}
+		}
+	}
+	if flags.nx && (flags.xx || flags.gt || flags.lt) {
+		return flags, &Value{typ: ERROR, str: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if flags.gt && flags.lt {
+		return flags, &Value{typ: ERROR, str: "ERR GT and LT options at the same time are not compatible"}
+	}
+	return flags, nil
+}
+
+// allow 按照参数判断是否可以把过期时间从 current 改为 when，没有过期时间的 key 相当于永不过期
+func (flags expireFlags) allow(current time.Time, when int64) bool {
+	volatile := current != time.Time{}
+	switch {
+	case flags.nx:
+		return !volatile
+	case flags.xx && !volatile:
+		return false
+	case flags.gt:
+		return volatile && when > current.UnixMilli()
+	case flags.lt:
+		return !volatile || when < current.UnixMilli()
+	}
+	return true
+}
+
+// expireTimestamp 把时间参数换算成毫秒级的 Unix 时间戳，unit 是参数的单位，absolute 表示参数本身是时间戳，
+// 溢出时返回 false
+func expireTimestamp(n int64, unit time.Duration, absolute bool) (int64, bool) {
+	if unit == time.Second {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, false
+		}
+		n *= 1000
+	}
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if n > math.MaxInt64-now {
+			return 0, false
+		}
+		n += now
+	}
+	return n, true
+}
+
+// expireOptions SET 和 GETEX 的过期时间参数：时间单位以及是否为 Unix 时间戳
+var expireOptions = map[string]struct {
+	unit     time.Duration
+	absolute bool
+}{
+	"EX":   {time.Second, false},
+	"PX":   {time.Millisecond, false},
+	"EXAT": {time.Second, true},
+	"PXAT": {time.Millisecond, true},
+}
+
+// parseExpireOption 解析 SET/GETEX 的 EX|PX|EXAT|PXAT 参数，返回毫秒级的 Unix 时间戳，时间必须是正数
+func parseExpireOption(option, arg, name string) (int64, *Value) {
+	spec := expireOptions[option]
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, &Value{typ: ERROR, str: "ERR value is not an integer or out of range"}
+	}
+	when, ok := expireTimestamp(n, spec.unit, spec.absolute)
+	if n <= 0 || !ok {
+		return 0, &Value{typ: ERROR, str: "ERR invalid expire time in '" + name + "' command"}
+	}
+	return when, nil
+}
+
+// expireGeneric EXPIRE/PEXPIRE/EXPIREAT/PEXPIREAT key time [NX|XX|GT|LT] 的公共实现。
+// 过期时间已经过去时直接删除 key。AOF 中统一记录为 PEXPIREAT，回放时同样会删除已经过期的 key
+func expireGeneric(sc *ServerConnection, args []Value, name string, unit time.Duration, absolute bool) Value {
+	if len(args) < 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+	key := string(args[0].bulk)
+	flags, errValue := parseExpireFlags(args[2:])
+	if errValue != nil {
+		return *errValue
+	}
+	n, err := strconv.ParseInt(string(args[1].bulk), 10, 64)
+	if err != nil {
+		return Value{typ: ERROR, str: "ERR value is not an integer or out of range"}
+	}
+	when, ok := expireTimestamp(n, unit, absolute)
+	if !ok {
+		return Value{typ: ERROR, str: "ERR invalid expire time in '" + name + "' command"}
+	}
+
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, exists := db.lookupForWrite(key)
+	if !exists || !flags.allow(entry.ExpiryInMS, when) {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+
+	if when <= time.Now().UnixMilli() {
+		db.remove(key)
+	} else {
+		entry.ExpiryInMS = time.UnixMilli(when)
+		db.set(key, entry)
+	}
+	sc.propagate("PEXPIREAT", key, strconv.FormatInt(when, 10))
+	dirty.Add(1)
+	return Value{typ: INTEGER, num: 1}
+}
+
+func expire(sc *ServerConnection, args []Value) Value {
+	return expireGeneric(sc, args, "expire", time.Second, false)
+}
+
+func pExpire(sc *ServerConnection, args []Value) Value {
+	return expireGeneric(sc, args, "pexpire", time.Millisecond, false)
+}
+
+func expireAt(sc *ServerConnection, args []Value) Value {
+	return expireGeneric(sc, args, "expireat", time.Second, true)
+}
+
+func pExpireAt(sc *ServerConnection, args []Value) Value {
+	return expireGeneric(sc, args, "pexpireat", time.Millisecond, true)
+}
+
+// lookupExpiry 读取 key 的过期时间，key 不存在时返回 -2，没有过期时间时返回 -1
+func lookupExpiry(sc *ServerConnection, args []Value, name string) (time.Time, *Value) {
+	if len(args) != 1 {
+		return time.Time{}, &Value{typ: ERROR, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	entry, ok := db.lookup(string(args[0].bulk))
+	if !ok {
+		return time.Time{}, &Value{typ: INTEGER, num: -2}
+	}
+	if (entry.ExpiryInMS == time.Time{}) {
+		return time.Time{}, &Value{typ: INTEGER, num: -1}
+	}
+	return entry.ExpiryInMS, nil
+}
+
+// ttlGeneric TTL/PTTL 返回剩余的生存时间，TTL 四舍五入到秒
+func ttlGeneric(sc *ServerConnection, args []Value, name string, unit time.Duration) Value {
+	expiry, reply := lookupExpiry(sc, args, name)
+	if reply != nil {
+		return *reply
+	}
+	// time.Until 在大约 292 年后饱和，直接用毫秒时间戳相减
+	ttl := expiry.UnixMilli() - time.Now().UnixMilli()
+	if ttl < 0 {
+		ttl = 0
+	}
+	if unit == time.Second {
+		ttl = (ttl + 500) / 1000
+	}
+	return Value{typ: INTEGER, num: int(ttl)}
+}
+
+func ttl(sc *ServerConnection, args []Value) Value {
+	return ttlGeneric(sc, args, "ttl", time.Second)
+}
+
+func pTTL(sc *ServerConnection, args []Value) Value {
+	return ttlGeneric(sc, args, "pttl", time.Millisecond)
+}
+
+// expireTimeGeneric EXPIRETIME/PEXPIRETIME 返回过期时间的 Unix 时间戳
+func expireTimeGeneric(sc *ServerConnection, args []Value, name string, unit time.Duration) Value {
+	expiry, reply := lookupExpiry(sc, args, name)
+	if reply != nil {
+		return *reply
+	}
+	when := expiry.UnixMilli()
+	if unit == time.Second {
+		when /= 1000
+	}
+	return Value{typ: INTEGER, num: int(when)}
+}
+
+func expireTime(sc *ServerConnection, args []Value) Value {
+	return expireTimeGeneric(sc, args, "expiretime", time.Second)
+}
+
+func pExpireTime(sc *ServerConnection, args []Value) Value {
+	return expireTimeGeneric(sc, args, "pexpiretime", time.Millisecond)
+}
+
+// persist PERSIST key，去掉 key 的过期时间，key 不存在或者没有过期时间时返回 0
+func persist(sc *ServerConnection, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'persist' command"}
+	}
+	key := string(args[0].bulk)
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, ok := db.lookupForWrite(key)
+	if !ok || (entry.ExpiryInMS == time.Time{}) {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	entry.ExpiryInMS = time.Time{}
+	db.set(key, entry)
+	dirty.Add(1)
+	return Value{typ: INTEGER, num: 1}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestActiveExpire(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	now := time.Now()
+	for _, index := range []int{0, 3} {
+		db := databases[index]
+		db.Mu.Lock()
+		for i := 0; i < 200; i++ {
+			db.set("expired"+strconv.Itoa(i), &Entry{Type: TypeString, Value: []byte("v"), ExpiryInMS: now.Add(-time.Second)})
+		}
+		for i := 0; i < 10; i++ {
+			db.set("future"+strconv.Itoa(i), &Entry{Type: TypeString, Value: []byte("v"), ExpiryInMS: now.Add(time.Hour)})
+			db.set("persistent"+strconv.Itoa(i), &Entry{Type: TypeString, Value: []byte("v")})
+		}
+		db.Mu.Unlock()
+	}
+
+	// 每轮抽样中过期的超过 25% 就继续抽样，几轮之内应该能删完
+	next := 0
+	for i := 0; i < 10; i++ {
+		next = activeExpireCycle(next)
+	}
+	for _, index := range []int{0, 3} {
+		db := databases[index]
+		db.Mu.RLock()
+		keys, expires := len(db.Data), len(db.Expires)
+		db.Mu.RUnlock()
+		if keys != 20 || expires != 10 {
+			t.Errorf("db %d has %d keys and %d expires, want 20 and 10", index, keys, expires)
+		}
+	}
+}
+
+func TestExpiresIndex(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	db := databases[0]
+	expiresLen := func() int {
+		db.Mu.RLock()
+		defer db.Mu.RUnlock()
+		return len(db.Expires)
+	}
+	call("SET", "k", "v", "EX", "100")
+	if got := expiresLen(); got != 1 {
+		t.Fatalf("Expires after SET EX = %d, want 1", got)
+	}
+	// 没有过期时间的 SET 覆盖之后，key 不再在索引中
+	call("SET", "k", "v")
+	if got := expiresLen(); got != 0 {
+		t.Errorf("Expires after SET without EX = %d, want 0", got)
+	}
+	call("SET", "k", "v", "PX", "100000")
+	call("FLUSHDB")
+	if got := expiresLen(); got != 0 {
+		t.Errorf("Expires after FLUSHDB = %d, want 0", got)
+	}
+}
+
+func TestExpireFlags(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	tests := []struct {
+		name  string
+		setup []string // 为空表示 key 没有过期时间
+		args  []string
+		want  int
+		ttl   int // 执行之后的 TTL，-1 表示没有过期时间
+	}{
+		{"no flag", nil, []string{"100"}, 1, 100},
+		{"NX without ttl", nil, []string{"100", "NX"}, 1, 100},
+		{"NX with ttl", []string{"EX", "50"}, []string{"100", "NX"}, 0, 50},
+		{"XX without ttl", nil, []string{"100", "XX"}, 0, -1},
+		{"XX with ttl", []string{"EX", "50"}, []string{"100", "XX"}, 1, 100},
+		// 没有过期时间的 key 相当于永不过期，GT 不会成功，LT 总会成功
+		{"GT without ttl", nil, []string{"100", "GT"}, 0, -1},
+		{"GT greater", []string{"EX", "50"}, []string{"100", "GT"}, 1, 100},
+		{"GT smaller", []string{"EX", "50"}, []string{"10", "GT"}, 0, 50},
+		{"LT without ttl", nil, []string{"100", "LT"}, 1, 100},
+		{"LT smaller", []string{"EX", "50"}, []string{"10", "LT"}, 1, 10},
+		{"LT greater", []string{"EX", "50"}, []string{"100", "LT"}, 0, 50},
+		{"XX GT", []string{"EX", "50"}, []string{"100", "XX", "GT"}, 1, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call(append([]string{"SET", "k", "v"}, tt.setup...)...)
+			if got := call(append([]string{"EXPIRE", "k"}, tt.args...)...); got.typ != INTEGER || got.num != tt.want {
+				t.Errorf("EXPIRE k %v = %+v, want %d", tt.args, got, tt.want)
+			}
+			if got := call("TTL", "k"); got.num != tt.ttl {
+				t.Errorf("TTL k = %d, want %d", got.num, tt.ttl)
+			}
+		})
+	}
+
+	for _, args := range [][]string{
+		{"EXPIRE", "k", "10", "NX", "XX"},
+		{"EXPIRE", "k", "10", "GT", "LT"},
+		{"EXPIRE", "k", "10", "YY"},
+		{"EXPIRE", "k", "ten"},
+		{"EXPIRE", "k", "9223372036854775807"},
+		{"PEXPIRE", "k", "9223372036854775807"},
+	} {
+		if got := call(args...); got.typ != ERROR {
+			t.Errorf("%v = %+v, want an error", args, got)
+		}
+	}
+	if got := call("EXPIRE", "missing", "10"); got.num != 0 {
+		t.Errorf("EXPIRE missing = %+v, want 0", got)
+	}
+}
+
+func TestExpireCommands(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	if got := call("TTL", "missing"); got.num != -2 {
+		t.Errorf("TTL missing = %d, want -2", got.num)
+	}
+	call("SET", "k", "v")
+	if got := call("PTTL", "k"); got.num != -1 {
+		t.Errorf("PTTL without expiry = %d, want -1", got.num)
+	}
+
+	when := time.Now().Add(time.Hour).UnixMilli()
+	call("PEXPIREAT", "k", strconv.FormatInt(when, 10))
+	if got := call("PEXPIRETIME", "k"); int64(got.num) != when {
+		t.Errorf("PEXPIRETIME = %d, want %d", got.num, when)
+	}
+	if got := call("EXPIRETIME", "k"); int64(got.num) != when/1000 {
+		t.Errorf("EXPIRETIME = %d, want %d", got.num, when/1000)
+	}
+	if got := call("PTTL", "k"); got.num <= 3590000 || got.num > 3600000 {
+		t.Errorf("PTTL = %d, want about an hour", got.num)
+	}
+
+	if got := call("PERSIST", "k"); got.num != 1 {
+		t.Errorf("PERSIST = %+v, want 1", got)
+	}
+	if got := call("PERSIST", "k"); got.num != 0 {
+		t.Errorf("PERSIST without expiry = %+v, want 0", got)
+	}
+	if got := call("TTL", "k"); got.num != -1 {
+		t.Errorf("TTL after PERSIST = %d, want -1", got.num)
+	}
+
+	// 过期时间已经过去时直接删除 key
+	if got := call("EXPIREAT", "k", "1"); got.num != 1 {
+		t.Errorf("EXPIREAT in the past = %+v, want 1", got)
+	}
+	if lookupEntry("k") != nil {
+		t.Error("EXPIREAT in the past did not delete the key")
+	}
+}
+
+func TestExpirePropagation(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	// 相对时间在 AOF 中记录为绝对的 PEXPIREAT，回放时不会因为重启而延后
+	sc := &ServerConnection{}
+	callOn(sc, "SET", "k", "v")
+	before := time.Now().UnixMilli()
+	callOn(sc, "EXPIRE", "k", "100")
+	if sc.aofCommand == nil || len(sc.aofCommand.array) != 3 || string(sc.aofCommand.array[0].bulk) != "PEXPIREAT" {
+		t.Fatalf("EXPIRE propagated as %+v, want PEXPIREAT", sc.aofCommand)
+	}
+	when, _ := strconv.ParseInt(string(sc.aofCommand.array[2].bulk), 10, 64)
+	if when < before+100000 || when > time.Now().UnixMilli()+100000 {
+		t.Errorf("propagated PEXPIREAT %d, want now + 100s", when)
+	}
+
+	// 没有修改数据的命令不写入 AOF
+	sc.aofCommand = nil
+	callOn(sc, "EXPIRE", "k", "10", "GT")
+	if sc.aofCommand == nil || len(sc.aofCommand.array) != 0 {
+		t.Errorf("EXPIRE that changed nothing propagated as %+v", sc.aofCommand)
+	}
+	sc.aofCommand = nil
+	callOn(sc, "PERSIST", "missing")
+	if sc.aofCommand == nil || len(sc.aofCommand.array) != 0 {
+		t.Errorf("PERSIST that changed nothing propagated as %+v", sc.aofCommand)
+	}
+}
+
+func TestTTLFarFuture(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	// 500 年之后超出了 time.Duration 的范围，TTL 不能停在 292 年
+	when := time.Now().AddDate(500, 0, 0).UnixMilli()
+	call("SET", "k", "v")
+	call("PEXPIREAT", "k", strconv.FormatInt(when, 10))
+	want := int(when - time.Now().UnixMilli())
+	if got := call("PTTL", "k"); got.num < want-1000 || got.num > want {
+		t.Errorf("PTTL = %d, want about %d", got.num, want)
+	}
+}
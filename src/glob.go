@@ -0,0 +1,84 @@
+package main
+
+// globMatch 判断 str 是否匹配 glob 模式，规则和 Redis 的 stringmatchlen 一致：
+//
+//   - "*" 匹配任意长度（包括 0）的字符串，"?" 匹配任意一个字符
+//   - "[abc]" 匹配括号中的任意一个字符，"[^abc]" 匹配不在括号中的字符，"[a-z]" 匹配范围内的字符
+//   - "\x" 匹配字符 x 本身，用来转义上面的特殊字符
+//
+// 遇到不匹配时回退到最近的 * 多吃一个字符重试，不需要递归
+func globMatch(pattern, str string) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0
+	for s < len(str) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				starP, starS = p, s
+				p++
+				continue
+			}
+			if width, ok := matchOne(pattern[p:], str[s]); ok {
+				p += width
+				s++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		p, s = starP+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne 用模式开头的一个元素（不是 *）匹配字符 c，返回这个元素在模式中占用的长度
+func matchOne(pattern string, c byte) (width int, matched bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		return matchClass(pattern, c)
+	case '\\':
+		// 模式末尾单独的 \ 匹配它自己
+		if len(pattern) >= 2 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// matchClass 匹配 [...] 字符集合，没有 ] 时一直到模式末尾都算在集合里
+func matchClass(pattern string, c byte) (width int, matched bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case pattern[i] == ']':
+			return i + 1, matched != negate
+		case i+2 < len(pattern) && pattern[i+1] == '-':
+			start, end := pattern[i], pattern[i+2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				matched = true
+			}
+			i += 2
+		case pattern[i] == c:
+			matched = true
+		}
+	}
+	return len(pattern), matched != negate
+}
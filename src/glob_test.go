@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*b", "axxb", true},
+		{"a*b", "axxc", false},
+		{"a*a*a", "aaa", true},
+		{"*a*", "bab", true},
+		{"a*b*c", "abxbc", true},
+		{"**", "x", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		// 范围的两端反过来也可以
+		{"[z-a]", "m", true},
+		{"[^a-c]", "d", true},
+		{"[^a-c]", "b", false},
+		{"[a\\]]", "]", true},
+		{"[\\-]", "-", true},
+		// 没有 ] 时一直到模式末尾都是集合
+		{"[abc", "b", true},
+		{"[abc", "[", false},
+		{"[", "[", false},
+		{"[", "", false},
+		{"[]", "]", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"\\?", "?", true},
+		{"\\[a]", "[a]", true},
+		{"a\\", "a\\", true},
+		{"\\a", "a", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+}
@@ -1 +1,3 @@
 module my-redis-go
+
+go 1.19
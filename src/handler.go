@@ -1,220 +1,590 @@
 package main
 
 import (
-	"fmt"
+	"math"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-var Handlers = map[string]func([]Value) Value{
-	"CONFIG":  configGet,
+// Handlers 命令处理函数，sc 是发出命令的连接，用于读取和修改连接级别的状态（例如当前选择的数据库）
+var Handlers = map[string]func(sc *ServerConnection, args []Value) Value{
+	"CONFIG":  config,
 	"PING":    ping,
 	"ECHO":    echo,
 	"SET":     set,
 	"GET":     get,
+	"SETNX":   setNX,
+	"SETEX":   setEX,
+	"PSETEX":  pSetEX,
+	"GETSET":  getSet,
+	"GETDEL":  getDel,
+	"GETEX":   getEx,
 	"HSET":    hSet,
 	"HGET":    hGet,
 	"HGETALL": hGetAll,
+	"RPUSH":   rPush,
+	"SADD":    sAdd,
+	"ZADD":    zAdd,
 	"KEYS":    keys,
-}
+	"SCAN":    scan,
+	"HSCAN":   hScan,
 
-type Entry struct {
-	Type        string
-	Value       any
-	TimeCreated time.Time
-	ExpiryInMS  time.Time
-}
+	"BGREWRITEAOF": bgRewriteAof,
+	"SAVE":         save,
+	"BGSAVE":       bgSave,
+	"LASTSAVE":     lastSave,
+	"SHUTDOWN":     shutdown,
+	"INFO":         info,
 
-func ping(args []Value) Value {
-	_ = args
-	return Value{typ: STRING, str: "PONG"}
+	"SELECT":   selectDB,
+	"MOVE":     move,
+	"SWAPDB":   swapDB,
+	"FLUSHDB":  flushDB,
+	"FLUSHALL": flushAll,
+	"DBSIZE":   dbSize,
+
+	"DEL":      del,
+	"UNLINK":   unlink,
+	"EXISTS":   exists,
+	"TOUCH":    touch,
+	"TYPE":     keyType,
+	"RENAME":   rename,
+	"RENAMENX": renameNX,
+	"COPY":     copyKey,
+
+	"EXPIRE":      expire,
+	"PEXPIRE":     pExpire,
+	"EXPIREAT":    expireAt,
+	"PEXPIREAT":   pExpireAt,
+	"TTL":         ttl,
+	"PTTL":        pTTL,
+	"EXPIRETIME":  expireTime,
+	"PEXPIRETIME": pExpireTime,
+	"PERSIST":     persist,
+
+	"CLIENT": client,
+	"HELLO":  hello,
 }
 
-func echo(args []Value) Value {
-	value := args[0].bulk
-	return Value{typ: STRING, str: value}
+// infoSections INFO 支持的段落，按输出顺序排列
+var infoSections = []struct {
+	name    string
+	content func() string
+}{
+	{"persistence", persistenceInfo},
+	{"keyspace", keyspaceInfo},
 }
 
-// todo-w 如何将 SETs 和 HSETs 放在一起？数据结构如何设计？
-// 将 SETs 设计为 key -> value，将 HSETs 设计为 hash:key -> value
+// info INFO [section ...]，不带参数或者 all/default/everything 时输出所有段落
+func info(sc *ServerConnection, args []Value) Value {
+	wanted := map[string]bool{}
+	for _, arg := range args {
+		wanted[strings.ToLower(string(arg.bulk))] = true
+	}
+	all := len(args) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
 
-// STORAGE 存储所有类型的数据
-//type STORAGE struct {
-//	Data map[string]*Entry
-//	Mu   sync.RWMutex
-//}
-//
-//var storage = STORAGE{}
+	var sections []string
+	for _, section := range infoSections {
+		if all || wanted[section.name] {
+			sections = append(sections, section.content())
+		}
+	}
+	return Value{typ: VERBATIM, bulk: []byte(strings.Join(sections, "\r\n"))}
+}
 
-var SETs = map[string]*Entry{}
+func ping(sc *ServerConnection, args []Value) Value {
+	_ = args
+	return Value{typ: STRING, str: "PONG"}
+}
 
-// SETsMu 获取 SETs 的读写互斥锁
-var SETsMu = sync.RWMutex{}
+func echo(sc *ServerConnection, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'echo' command"}
+	}
+	return Value{typ: BULK, bulk: args[0].bulk}
+}
 
-func set(args []Value) Value {
-	if len(args) != 2 && len(args) != 4 {
+// set SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|KEEPTTL]，
+// 会覆盖任意类型的旧值。带 GET 时返回旧值，旧值不是字符串时返回 WRONGTYPE 并且不写入
+func set(sc *ServerConnection, args []Value) Value {
+	if len(args) < 2 {
 		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'set' command"}
 	}
-	key := args[0].bulk
+	key := string(args[0].bulk)
 	value := args[1].bulk
-	now, expires := time.Now(), time.Time{}
-
-	if len(args) == 4 {
-		cmd := args[2].bulk
-		var duration int64
-		duration, _ = strconv.ParseInt(args[3].bulk, 10, 64)
-		switch strings.ToLower(cmd) {
-		case "ex":
-			expires = now.Add(time.Duration(duration) * time.Second)
-		case "px":
-			expires = now.Add(time.Duration(duration) * time.Millisecond)
+
+	var nx, xx, withGet, keepTTL bool
+	expireOption, expireArg := "", ""
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i].bulk))
+		_, isExpire := expireOptions[option]
+		switch {
+		case option == "NX" && !xx:
+			nx = true
+		case option == "XX" && !nx:
+			xx = true
+		case option == "GET":
+			withGet = true
+		case option == "KEEPTTL" && expireOption == "":
+			keepTTL = true
+		case isExpire && !keepTTL && expireOption == "" && i+1 < len(args):
+			expireOption, expireArg = option, string(args[i+1].bulk)
+			i++
 		default:
-			return Value{typ: ERROR, str: "ERR unknown unit " + cmd + ", should be EX or PX"}
+			return Value{typ: ERROR, str: "ERR syntax error"}
+		}
+	}
+	var expires time.Time
+	if expireOption != "" {
+		when, errValue := parseExpireOption(expireOption, expireArg, "set")
+		if errValue != nil {
+			return *errValue
+		}
+		expires = time.UnixMilli(when)
+	}
+
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, exists := db.lookupForWrite(key)
+	old := Value{typ: NULL}
+	if withGet && exists {
+		if entry.Type != TypeString {
+			return WrongTypeError
+		}
+		old = Value{typ: BULK, bulk: entry.Value.([]byte)}
+	}
+	if (nx && exists) || (xx && !exists) {
+		sc.skipPropagate()
+		if withGet {
+			return old
 		}
+		return Value{typ: NULL}
+	}
+	if keepTTL && exists {
+		expires = entry.ExpiryInMS
+	}
+
+	db.setString(key, value, expires)
+	sc.propagateSet(key, value, expires)
+	if withGet {
+		return old
 	}
+	return Value{typ: STRING, str: "OK"}
+}
 
-	//storage.Mu.Lock()
-	//storage.Data[key] = &Entry{
-	//	Type:        "SET",
-	//	Value:       value,
-	//	TimeCreated: now,
-	//	ExpiryInMS:  expires,
-	//}
-	//defer storage.Mu.Unlock()
-	SETsMu.Lock()
-	SETs[key] = &Entry{
+// setString 把 key 设置为字符串，覆盖任意类型的旧值，调用方需要持有写锁。
+// value 直接保存，不复制，调用方之后不能再修改它
+func (s *STORAGE) setString(key string, value []byte, expires time.Time) {
+	s.set(key, &Entry{
+		Type:        TypeString,
 		Value:       value,
-		TimeCreated: now,
+		TimeCreated: time.Now(),
 		ExpiryInMS:  expires,
+	})
+	dirty.Add(1)
+}
+
+// propagateSet 写入字符串的命令在 AOF 中统一记录为 SET，过期时间换成 PXAT 绝对时间戳
+func (sc *ServerConnection) propagateSet(key string, value []byte, expires time.Time) {
+	args := append(bulks("SET", key), Value{typ: BULK, bulk: value})
+	if (expires != time.Time{}) {
+		args = append(args, bulks("PXAT", strconv.FormatInt(expires.UnixMilli(), 10))...)
+	}
+	sc.aofCommand = &Value{typ: ARRAY, array: args}
+}
+
+// lookupString 查找一个用于写入的字符串，key 不存在时返回 false，类型不对时返回 WRONGTYPE 错误，调用方需要持有写锁
+func (s *STORAGE) lookupString(key string) (*Entry, bool, *Value) {
+	entry, ok := s.lookupForWrite(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if entry.Type != TypeString {
+		return nil, false, &WrongTypeError
+	}
+	return entry, true, nil
+}
+
+// setNX SETNX key value，key 不存在时才写入
+func setNX(sc *ServerConnection, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'setnx' command"}
+	}
+	key := string(args[0].bulk)
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	if _, exists := db.lookupForWrite(key); exists {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	db.setString(key, args[1].bulk, time.Time{})
+	return Value{typ: INTEGER, num: 1}
+}
+
+// setWithExpire SETEX/PSETEX key time value 的公共实现，option 是对应的 SET 参数
+func setWithExpire(sc *ServerConnection, args []Value, name, option string) Value {
+	if len(args) != 3 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for '" + name + "' command"}
 	}
-	defer SETsMu.Unlock()
+	key, value := string(args[0].bulk), args[2].bulk
+	when, errValue := parseExpireOption(option, string(args[1].bulk), name)
+	if errValue != nil {
+		return *errValue
+	}
+	expires := time.UnixMilli(when)
 
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	db.setString(key, value, expires)
+	sc.propagateSet(key, value, expires)
 	return Value{typ: STRING, str: "OK"}
 }
 
-func get(args []Value) Value {
+func setEX(sc *ServerConnection, args []Value) Value {
+	return setWithExpire(sc, args, "setex", "EX")
+}
+
+func pSetEX(sc *ServerConnection, args []Value) Value {
+	return setWithExpire(sc, args, "psetex", "PX")
+}
+
+// getSet GETSET key value，写入新值并返回旧值，新值没有过期时间
+func getSet(sc *ServerConnection, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'getset' command"}
+	}
+	key := string(args[0].bulk)
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, exists, errValue := db.lookupString(key)
+	if errValue != nil {
+		return *errValue
+	}
+	old := Value{typ: NULL}
+	if exists {
+		old = Value{typ: BULK, bulk: entry.Value.([]byte)}
+	}
+	db.setString(key, args[1].bulk, time.Time{})
+	return old
+}
+
+// getDel GETDEL key，返回字符串的值并删除 key
+func getDel(sc *ServerConnection, args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'get' command"}
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'getdel' command"}
 	}
-	key := args[0].bulk
-	//storage.Mu.RLock()
-	//entry, ok := storage.Data[key]
-	//defer storage.Mu.RUnlock()
+	key := string(args[0].bulk)
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, exists, errValue := db.lookupString(key)
+	if errValue != nil {
+		return *errValue
+	}
+	if !exists {
+		sc.skipPropagate()
+		return Value{typ: NULL}
+	}
+	db.remove(key)
+	dirty.Add(1)
+	return Value{typ: BULK, bulk: entry.Value.([]byte)}
+}
 
-	SETsMu.RLock()
-	entry, ok := SETs[key]
-	defer SETsMu.RUnlock()
+// getEx GETEX key [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|PERSIST]，
+// 返回字符串的值，同时修改或者去掉过期时间。AOF 中记录为 PEXPIREAT 或 PERSIST
+func getEx(sc *ServerConnection, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'getex' command"}
+	}
+	key := string(args[0].bulk)
+	persist := false
+	expireOption, expireArg := "", ""
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i].bulk))
+		_, isExpire := expireOptions[option]
+		switch {
+		case option == "PERSIST" && expireOption == "":
+			persist = true
+		case isExpire && !persist && expireOption == "" && i+1 < len(args):
+			expireOption, expireArg = option, string(args[i+1].bulk)
+			i++
+		default:
+			return Value{typ: ERROR, str: "ERR syntax error"}
+		}
+	}
+	var when int64
+	if expireOption != "" {
+		var errValue *Value
+		when, errValue = parseExpireOption(expireOption, expireArg, "getex")
+		if errValue != nil {
+			return *errValue
+		}
+	}
 
-	if !ok || (entry.ExpiryInMS.Before(time.Now()) && entry.ExpiryInMS != time.Time{}) {
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, exists, errValue := db.lookupString(key)
+	if errValue != nil {
+		return *errValue
+	}
+	if !exists {
+		sc.skipPropagate()
 		return Value{typ: NULL}
 	}
-	var value, _ = anyToString(entry.Value)
-	return Value{typ: STRING, str: value}
-}
+	value := Value{typ: BULK, bulk: entry.Value.([]byte)}
 
-func anyToString(value any) (string, error) {
-	// 使用类型断言检查是否为 string
-	if str, ok := value.(string); ok {
-		return str, nil
+	switch {
+	case expireOption != "":
+		if when <= time.Now().UnixMilli() {
+			db.remove(key)
+		} else {
+			entry.ExpiryInMS = time.UnixMilli(when)
+			db.set(key, entry)
+		}
+		sc.propagate("PEXPIREAT", key, strconv.FormatInt(when, 10))
+		dirty.Add(1)
+	case persist && (entry.ExpiryInMS != time.Time{}):
+		entry.ExpiryInMS = time.Time{}
+		db.set(key, entry)
+		sc.propagate("PERSIST", key)
+		dirty.Add(1)
+	default:
+		sc.skipPropagate()
 	}
-	return "", fmt.Errorf("value is not a string: %v", value)
+	return value
 }
 
-var HSETs = map[string]map[string]*Entry{}
-var HSETsMu = sync.RWMutex{}
+func get(sc *ServerConnection, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'get' command"}
+	}
+	key := string(args[0].bulk)
+
+	db := sc.database()
+	db.Mu.RLock()
+	entry, ok := db.lookup(key)
+	defer db.Mu.RUnlock()
 
-func hSet(args []Value) Value {
+	if !ok {
+		return Value{typ: NULL}
+	}
+	if entry.Type != TypeString {
+		return WrongTypeError
+	}
+	return Value{typ: BULK, bulk: entry.Value.([]byte)}
+}
+
+func hSet(sc *ServerConnection, args []Value) Value {
 	if len(args) < 3 || len(args)%2 != 1 {
 		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'hset' command"}
 	}
-	hash := args[0].bulk
+	hash := string(args[0].bulk)
 	pair := (len(args) - 1) / 2
 
-	HSETsMu.Lock()
-	_, ok := HSETs[hash]
-	if !ok {
-		HSETs[hash] = map[string]*Entry{}
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, errValue := db.lookupOrCreate(hash, TypeHash, func() any { return newHash(pair) })
+	if errValue != nil {
+		return *errValue
 	}
+
+	h := entry.Value.(*Hash)
+	added := 0
 	for i := 0; i < pair; i++ {
-		key := args[1+i*2].bulk
-		value := args[1+i*2+1].bulk
-		HSETs[hash][key] = &Entry{
-			Value:       value,
-			TimeCreated: time.Now(),
-			ExpiryInMS:  time.Time{},
+		if h.set(string(args[1+i*2].bulk), args[1+i*2+1].bulk) {
+			added++
 		}
 	}
+	dirty.Add(int64(pair))
 
-	defer HSETsMu.Unlock()
+	// 返回新增的字段数
+	return Value{typ: INTEGER, num: added}
+}
 
-	return Value{typ: STRING, str: "OK"}
+// lookupHash 查找一个 hash，key 不存在时返回一个空的 hash，类型不对时返回 WRONGTYPE 错误，调用方需要持有 Mu
+func (s *STORAGE) lookupHash(key string) (*Hash, *Value) {
+	entry, ok := s.lookup(key)
+	if !ok {
+		return &Hash{}, nil
+	}
+	if entry.Type != TypeHash {
+		return nil, &WrongTypeError
+	}
+	return entry.Value.(*Hash), nil
 }
 
-func hGet(args []Value) Value {
+func hGet(sc *ServerConnection, args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'hget' command"}
 	}
-	hash := args[0].bulk
-	key := args[1].bulk
+	hash := string(args[0].bulk)
+	key := string(args[1].bulk)
 
-	HSETsMu.RLock()
-	entry, ok := HSETs[hash][key]
-	defer HSETsMu.RUnlock()
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	h, errValue := db.lookupHash(hash)
+	if errValue != nil {
+		return *errValue
+	}
 
+	value, ok := h.Fields[key]
 	if !ok {
 		return Value{typ: NULL}
 	}
-	var value, _ = anyToString(entry.Value)
 	return Value{typ: BULK, bulk: value}
 }
 
-func hGetAll(args []Value) Value {
+func hGetAll(sc *ServerConnection, args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'hgetall' command"}
 	}
-	hash := args[0].bulk
-	HSETsMu.RLock()
-	value, ok := HSETs[hash]
-	defer HSETsMu.RUnlock()
+	hash := string(args[0].bulk)
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	h, errValue := db.lookupHash(hash)
+	if errValue != nil {
+		return *errValue
+	}
+
+	values := []Value{}
+	for k, v := range h.Fields {
+		values = append(values, Value{typ: BULK, bulk: []byte(k)})
+		values = append(values, Value{typ: BULK, bulk: v})
+	}
+	return Value{typ: MAP, array: values}
+}
 
+// lookupOrCreate 查找用于写入的 key，不存在时创建一个值为 empty() 的 typ 类型的 key，
+// 类型不对时返回 WRONGTYPE 错误，调用方需要持有写锁
+func (s *STORAGE) lookupOrCreate(key, typ string, empty func() any) (*Entry, *Value) {
+	entry, ok := s.lookupForWrite(key)
 	if !ok {
-		return Value{typ: NULL}
+		entry = &Entry{
+			Type:        typ,
+			Value:       empty(),
+			TimeCreated: time.Now(),
+		}
+		s.set(key, entry)
 	}
+	if entry.Type != typ {
+		return nil, &WrongTypeError
+	}
+	return entry, nil
+}
 
-	var values []Value
-	for k, e := range value {
-		var v, _ = anyToString(e.Value)
-		values = append(values, Value{typ: BULK, bulk: k})
-		values = append(values, Value{typ: BULK, bulk: v})
+// rPush RPUSH key element [element ...]，把元素追加到列表末尾，返回列表的长度
+func rPush(sc *ServerConnection, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'rpush' command"}
+	}
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, errValue := db.lookupOrCreate(string(args[0].bulk), TypeList, func() any { return []string{} })
+	if errValue != nil {
+		return *errValue
 	}
-	return Value{typ: ARRAY, array: values}
+
+	list := entry.Value.([]string)
+	for _, arg := range args[1:] {
+		list = append(list, string(arg.bulk))
+	}
+	entry.Value = list
+	dirty.Add(int64(len(args) - 1))
+	return Value{typ: INTEGER, num: len(list)}
 }
 
-// Returns all keys matching pattern.
-func keys(args []Value) Value {
-	if len(args) != 1 {
-		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'keys' command"}
+// sAdd SADD key member [member ...]，返回新加入的成员数
+func sAdd(sc *ServerConnection, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'sadd' command"}
+	}
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, errValue := db.lookupOrCreate(string(args[0].bulk), TypeSet, func() any { return map[string]struct{}{} })
+	if errValue != nil {
+		return *errValue
 	}
-	key := args[0].bulk
 
-	var value []Value
-	if key == "*" {
-		for setKey := range SETs {
-			value = append(value, Value{typ: BULK, bulk: setKey})
+	members := entry.Value.(map[string]struct{})
+	added := 0
+	for _, arg := range args[1:] {
+		member := string(arg.bulk)
+		if _, exists := members[member]; !exists {
+			members[member] = struct{}{}
+			added++
 		}
-	} else {
-		SETsMu.RLock()
-		entry, ok := SETs[key]
-		defer SETsMu.RUnlock()
-		if !ok {
-			return Value{typ: NULL}
+	}
+	dirty.Add(int64(added))
+	return Value{typ: INTEGER, num: added}
+}
+
+// zAdd ZADD key score member [score member ...]，已经存在的成员更新分数，返回新加入的成员数。
+// 分数全部解析成功之后才开始修改
+func zAdd(sc *ServerConnection, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'zadd' command"}
+	}
+	if len(args)%2 != 1 {
+		return Value{typ: ERROR, str: "ERR syntax error"}
+	}
+	scores := make([]float64, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(string(args[i].bulk), 64)
+		if err != nil || math.IsNaN(score) {
+			return Value{typ: ERROR, str: "ERR value is not a valid float"}
+		}
+		scores = append(scores, score)
+	}
+
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, errValue := db.lookupOrCreate(string(args[0].bulk), TypeZSet, func() any { return map[string]float64{} })
+	if errValue != nil {
+		return *errValue
+	}
+
+	members := entry.Value.(map[string]float64)
+	added := 0
+	for i, score := range scores {
+		member := string(args[2+i*2].bulk)
+		if _, exists := members[member]; !exists {
+			added++
 		}
-		valueString, _ := anyToString(entry.Value)
-		value = append(value, Value{typ: BULK, bulk: valueString})
+		members[member] = score
 	}
+	dirty.Add(int64(len(scores)))
+	return Value{typ: INTEGER, num: added}
+}
 
-	// 先支持SETs
+// keys KEYS pattern，返回所有匹配 glob 模式的 key。会遍历整个数据库，key 很多时应该使用 SCAN
+func keys(sc *ServerConnection, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'keys' command"}
+	}
+	pattern := string(args[0].bulk)
+
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	now := time.Now()
+	value := []Value{}
+	for name, entry := range db.Data {
+		if !entry.expired(now) && globMatch(pattern, name) {
+			value = append(value, Value{typ: BULK, bulk: []byte(name)})
+		}
+	}
 	return Value{typ: ARRAY, array: value}
 }
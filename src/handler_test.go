@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps [][2]string // 命令和期望的返回值
+	}{
+		{"plain", [][2]string{
+			{"SET k v", "OK"},
+			{"GET k", "v"},
+			{"TTL k", "(integer) -1"},
+		}},
+		{"NX", [][2]string{
+			{"SET k v NX", "OK"},
+			{"SET k w NX", "(nil)"},
+			{"GET k", "v"},
+		}},
+		{"XX", [][2]string{
+			{"SET k v XX", "(nil)"},
+			{"GET k", "(nil)"},
+			{"SET k v", "OK"},
+			{"SET k w xx", "OK"},
+			{"GET k", "w"},
+		}},
+		{"GET", [][2]string{
+			{"SET k v GET", "(nil)"},
+			{"SET k w GET", "v"},
+			{"SET k x NX GET", "w"},
+			{"GET k", "w"},
+		}},
+		{"GET wrong type", [][2]string{
+			{"RPUSH k a", "(integer) 1"},
+			{"SET k v GET", WrongTypeError.str},
+			{"SET k v", "OK"},
+		}},
+		{"EX and KEEPTTL", [][2]string{
+			{"SET k v EX 100", "OK"},
+			{"TTL k", "(integer) 100"},
+			{"SET k w KEEPTTL", "OK"},
+			{"TTL k", "(integer) 100"},
+			{"SET k x", "OK"},
+			{"TTL k", "(integer) -1"},
+		}},
+		{"PX", [][2]string{
+			{"SET k v PX 100000", "OK"},
+			{"TTL k", "(integer) 100"},
+		}},
+		{"past EXAT", [][2]string{
+			{"SET k v EXAT 1", "OK"},
+			{"GET k", "(nil)"},
+		}},
+		{"syntax errors", [][2]string{
+			{"SET k v NX XX", "ERR syntax error"},
+			{"SET k v EX 10 PX 10", "ERR syntax error"},
+			{"SET k v EX 10 KEEPTTL", "ERR syntax error"},
+			{"SET k v KEEPTTL EX 10", "ERR syntax error"},
+			{"SET k v EX", "ERR syntax error"},
+			{"SET k v FOO", "ERR syntax error"},
+			{"SET k v EX ten", "ERR value is not an integer or out of range"},
+			{"SET k v EX 0", "ERR invalid expire time in 'set' command"},
+			{"SET k v PX -1", "ERR invalid expire time in 'set' command"},
+			{"SET k v EX 9223372036854775807", "ERR invalid expire time in 'set' command"},
+			{"GET k", "(nil)"},
+		}},
+		{"SETNX", [][2]string{
+			{"SETNX k v", "(integer) 1"},
+			{"SETNX k w", "(integer) 0"},
+			{"GET k", "v"},
+		}},
+		{"SETEX and PSETEX", [][2]string{
+			{"SETEX k 100 v", "OK"},
+			{"TTL k", "(integer) 100"},
+			{"PSETEX k 100000 w", "OK"},
+			{"GET k", "w"},
+			{"TTL k", "(integer) 100"},
+			{"SETEX k 0 v", "ERR invalid expire time in 'setex' command"},
+		}},
+		{"GETSET", [][2]string{
+			{"GETSET k v", "(nil)"},
+			{"EXPIRE k 100", "(integer) 1"},
+			{"GETSET k w", "v"},
+			{"TTL k", "(integer) -1"},
+		}},
+		{"GETDEL", [][2]string{
+			{"GETDEL k", "(nil)"},
+			{"SET k v", "OK"},
+			{"GETDEL k", "v"},
+			{"GET k", "(nil)"},
+		}},
+		{"GETEX", [][2]string{
+			{"GETEX k EX 100", "(nil)"},
+			{"SET k v", "OK"},
+			{"GETEX k", "v"},
+			{"TTL k", "(integer) -1"},
+			{"GETEX k EX 100", "v"},
+			{"TTL k", "(integer) 100"},
+			{"GETEX k PERSIST", "v"},
+			{"TTL k", "(integer) -1"},
+			{"GETEX k PERSIST EX 10", "ERR syntax error"},
+			{"GETEX k PXAT 1", "v"},
+			{"GET k", "(nil)"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore()
+			t.Cleanup(resetStore)
+			runSteps(t, tt.steps)
+		})
+	}
+}
+
+func TestSetPropagation(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	// 相对的过期时间在 AOF 中记录为 PXAT 绝对时间戳
+	sc := &ServerConnection{}
+	before := time.Now().UnixMilli()
+	callOn(sc, "SETEX", "k", "100", "v")
+	args := sc.aofCommand.array
+	if len(args) != 5 || string(args[0].bulk) != "SET" || string(args[3].bulk) != "PXAT" {
+		t.Fatalf("SETEX propagated as %+v, want SET k v PXAT ms", sc.aofCommand)
+	}
+	if when, _ := strconv.ParseInt(string(args[4].bulk), 10, 64); when < before+100000 || when > time.Now().UnixMilli()+100000 {
+		t.Errorf("propagated PXAT %d, want now + 100s", when)
+	}
+
+	sc.aofCommand = nil
+	callOn(sc, "SET", "k", "w", "NX")
+	if sc.aofCommand == nil || len(sc.aofCommand.array) != 0 {
+		t.Errorf("SET NX that changed nothing propagated as %+v", sc.aofCommand)
+	}
+
+	sc.aofCommand = nil
+	callOn(sc, "GETEX", "k", "PERSIST")
+	if args := sc.aofCommand.array; len(args) != 2 || string(args[0].bulk) != "PERSIST" {
+		t.Errorf("GETEX PERSIST propagated as %+v, want PERSIST k", sc.aofCommand)
+	}
+}
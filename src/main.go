@@ -2,7 +2,31 @@ package main
 
 func main() {
 	initConfigs()
-	loadRdbFileIntoKVMemoryStore()
+	// 上次在 AOF 重写过程中退出时，临时文件不会被删除
+	ConfigsMu.RLock()
+	removeAofRewriteTempFiles(Configs["dir"])
+	ConfigsMu.RUnlock()
+	// 开启 AOF 且 AOF 文件存在时，以 AOF 为准，不再加载 RDB
+	if aofEnabled() {
+		seed := !fileNotEmpty(aofPath())
+		if seed {
+			loadRdbFile()
+		}
+		if err := loadAofFileIntoKVMemoryStore(); err != nil {
+			logger.Fatal("Failed to load AOF: %s", err.Error())
+		}
+		// AOF 为空时用一次重写把从 RDB 加载的数据写进去，否则下次启动只加载 AOF 会丢失这部分数据
+		if seed {
+			if err := AOF.Rewrite(false); err != nil {
+				logger.Fatal("Failed to write AOF: %s", err.Error())
+			}
+		}
+		defer AOF.Close()
+	} else {
+		loadRdbFile()
+	}
+	// 加载数据时执行的 SET/HSET 不算作修改
+	dirty.Store(0)
 
 	server := &Server{}
 	defer server.Close()
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"my-redis-go/logging"
+)
+
+func TestMain(m *testing.M) {
+	logger = logging.Logger{Level: logging.LevelOff}
+	_ = setProtoMaxBulkLen(*protoMaxBulkLenStr)
+	resetStore()
+	os.Exit(m.Run())
+}
+
+// command 把参数构造成客户端发来的命令
+func command(args ...string) Value {
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		values[i] = Value{typ: BULK, bulk: []byte(arg)}
+	}
+	return Value{typ: ARRAY, array: values}
+}
+
+// call 在一个新连接（0 号数据库）上直接调用命令对应的 handler，不经过网络
+func call(args ...string) Value {
+	return callOn(&ServerConnection{}, args...)
+}
+
+// callOn 在 sc 上调用命令，SELECT 之类的命令会修改 sc 的状态
+func callOn(sc *ServerConnection, args ...string) Value {
+	handle, ok := Handlers[strings.ToUpper(args[0])]
+	if !ok {
+		return Value{typ: ERROR, str: "ERR unknown command '" + args[0] + "'"}
+	}
+	return handle(sc, command(args...).array[1:])
+}
+
+// text 取出简单字符串或批量字符串回复的内容
+func text(v Value) string {
+	if v.typ == BULK {
+		return string(v.bulk)
+	}
+	return v.str
+}
+
+// resetStore 清空内存中的所有数据
+func resetStore() {
+	initDatabases(16)
+}
+
+// lookupEntry 直接读取 0 号数据库中的 key，不检查过期，不存在时返回 nil
+func lookupEntry(key string) *Entry {
+	return lookupEntryIn(0, key)
+}
+
+func lookupEntryIn(db int, key string) *Entry {
+	databases[db].Mu.RLock()
+	defer databases[db].Mu.RUnlock()
+	return databases[db].Data[key]
+}
+
+// setConfig 在测试期间修改一项配置，测试结束后恢复原值
+func setConfig(t *testing.T, key, value string) {
+	t.Helper()
+	ConfigsMu.Lock()
+	old, ok := Configs[key]
+	Configs[key] = value
+	ConfigsMu.Unlock()
+	t.Cleanup(func() {
+		ConfigsMu.Lock()
+		defer ConfigsMu.Unlock()
+		if ok {
+			Configs[key] = old
+		} else {
+			delete(Configs, key)
+		}
+	})
+}
+
+// reply 把返回值转成便于比较的字符串，null 为 (nil)，整数为 (integer) n
+func reply(v Value) string {
+	switch v.typ {
+	case NULL:
+		return "(nil)"
+	case INTEGER:
+		return "(integer) " + strconv.Itoa(v.num)
+	}
+	return text(v)
+}
+
+// runSteps 依次执行用空格分隔的命令，检查每一步的返回值
+func runSteps(t *testing.T, steps [][2]string) {
+	t.Helper()
+	for _, step := range steps {
+		if got := reply(call(strings.Fields(step[0])...)); got != step[1] {
+			t.Errorf("%s = %q, want %q", step[0], got, step[1])
+		}
+	}
+}
+
+// testHash 用字段和值交替排列的参数构造一个 hash
+func testHash(pairs ...string) *Hash {
+	hash, err := pairsToHash(pairs)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// plainValue 把值转换成可以用 reflect.DeepEqual 比较的形式，hash 只比较字段，不比较遍历索引的内部结构
+func plainValue(value any) any {
+	if hash, ok := value.(*Hash); ok {
+		return hash.Fields
+	}
+	return value
+}
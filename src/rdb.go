@@ -1,11 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,184 +26,1085 @@ import (
  */
 
 const (
-	opCodeTypeString   byte = 0   /*following byte(s) are length encoding. */
-	opCodeModuleAux    byte = 247 /* Module auxiliary data. */
-	opCodeIdle         byte = 248 /* LRU idle time. */
-	opCodeFreq         byte = 249 /* LFU frequency. */
-	opCodeAux          byte = 250 /* RDB aux field. */
-	opCodeResizeDB     byte = 251 /* Hash table resize hint. */
-	opCodeExpireTimeMs byte = 252 /* Expire time in milliseconds. */
-	opCodeExpireTime   byte = 253 /* Old expire time in seconds. */
-	opCodeSelectDB     byte = 254 /* DB number of the following keys. */
-	opCodeEOF          byte = 255
+	opCodeTypeString byte = 0 /*following byte(s) are length encoding. */
+	opCodeTypeList   byte = 1
+	opCodeTypeSet    byte = 2
+	opCodeTypeZSet   byte = 3
+	opCodeTypeHash   byte = 4 /* Hash as length-prefixed field/value pairs. */
+	opCodeTypeZSet2  byte = 5 /* ZSET version 2 with doubles stored in binary. */
+
+	opCodeTypeHashZipmap     byte = 9
+	opCodeTypeListZiplist    byte = 10
+	opCodeTypeSetIntset      byte = 11
+	opCodeTypeZSetZiplist    byte = 12
+	opCodeTypeHashZiplist    byte = 13
+	opCodeTypeListQuicklist  byte = 14
+	opCodeTypeHashListpack   byte = 16
+	opCodeTypeZSetListpack   byte = 17
+	opCodeTypeListQuicklist2 byte = 18
+	opCodeTypeSetListpack    byte = 20
+
+	opCodeSlotInfo      byte = 244 /* Cluster slot info, Redis 7.4+. */
+	opCodeFunction2     byte = 245 /* Function library data. */
+	opCodeFunctionPreGA byte = 246 /* Old function library data, never released. */
+	opCodeModuleAux     byte = 247 /* Module auxiliary data. */
+	opCodeIdle          byte = 248 /* LRU idle time. */
+	opCodeFreq          byte = 249 /* LFU frequency. */
+	opCodeAux           byte = 250 /* RDB aux field. */
+	opCodeResizeDB      byte = 251 /* Hash table resize hint. */
+	opCodeExpireTimeMs  byte = 252 /* Expire time in milliseconds. */
+	opCodeExpireTime    byte = 253 /* Old expire time in seconds. */
+	opCodeSelectDB      byte = 254 /* DB number of the following keys. */
+	opCodeEOF           byte = 255
 )
 
-func loadRdbFileIntoKVMemoryStore() {
-	content, err := os.ReadFile(fmt.Sprintf("%s/%s", *dir, *dbFileName))
+// redisVersion 兼容的 Redis 版本，写在 RDB 的 redis-ver 字段和 HELLO 的回复中
+const redisVersion = "7.2.0"
+
+// rdbVersion 写出的 RDB 版本，只使用不压缩的基本编码，Redis 5 之后的版本都能加载
+const rdbVersion = 9
+
+// rdbMaxSupportedVersion 能加载的最高 RDB 版本（Redis 7.4）
+const rdbMaxSupportedVersion = 12
+
+func rdbPath() string {
+	ConfigsMu.RLock()
+	defer ConfigsMu.RUnlock()
+	return filepath.Join(Configs["dir"], Configs["dbfilename"])
+}
+
+// loadRdbFileIntoKVMemoryStore 加载 RDB 文件，文件不存在时什么都不做。
+// 文件必须完整地解析成功并且通过校验后才会写入内存，不会只加载一部分数据。
+func loadRdbFileIntoKVMemoryStore() error {
+	file, err := os.Open(rdbPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		logger.Error(err.Error())
-		return
+		return err
 	}
-	if len(content) == 0 {
-		return
+	defer file.Close()
+
+	ConfigsMu.RLock()
+	verify := Configs["rdbchecksum"] == "yes"
+	ConfigsMu.RUnlock()
+
+	now := time.Now()
+	dbs := make([]map[string]*Entry, len(databases))
+	for i := range dbs {
+		dbs[i] = map[string]*Entry{}
+	}
+	loaded, expired := 0, 0
+	err = parseRDB(bufio.NewReader(file), verify, func(key rdbKey) error {
+		if key.db >= len(dbs) {
+			return &rdbDBIndexError{db: key.db, databases: len(dbs)}
+		}
+		// 加载时已经过期的 key 直接丢弃
+		if (key.expiry != time.Time{}) && !key.expiry.After(now) {
+			expired++
+			return nil
+		}
+		entry := &Entry{
+			Value:       key.value,
+			TimeCreated: now,
+			ExpiryInMS:  key.expiry,
+		}
+		switch key.value.(type) {
+		case []byte:
+			entry.Type = TypeString
+		case *Hash:
+			entry.Type = TypeHash
+		case []string:
+			entry.Type = TypeList
+		case map[string]struct{}:
+			entry.Type = TypeSet
+		case map[string]float64:
+			entry.Type = TypeZSet
+		}
+		dbs[key.db][key.key] = entry
+		loaded++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	data, err := parseRDB(content)
-	if err != nil && err.Error() != "EOF" {
-		logger.Error(err.Error())
+	for i, data := range dbs {
+		databases[i].Mu.Lock()
+		for key, entry := range data {
+			databases[i].set(key, entry)
+		}
+		databases[i].Mu.Unlock()
+	}
+
+	logger.Info("RDB loaded %d keys, discarded %d expired keys", loaded, expired)
+	return nil
+}
+
+// 加载损坏的 RDB 文件时的处理方式
+const (
+	RdbCorruptExit   = "exit"   // 拒绝启动
+	RdbCorruptRename = "rename" // 把损坏的文件改名放到一边，以空数据启动
+)
+
+// rdbDBIndexError RDB 文件中的数据库编号超出了 databases 配置。文件本身没有损坏，是配置的问题
+type rdbDBIndexError struct {
+	db, databases int
+}
+
+func (e *rdbDBIndexError) Error() string {
+	return fmt.Sprintf("DB index %d out of range, increase databases (currently %d)", e.db, e.databases)
+}
+
+// loadRdbFile 加载 RDB 文件，按 rdb-load-corrupt 处理损坏的文件，配置错误时不论哪种处理方式都拒绝启动
+func loadRdbFile() {
+	err := loadRdbFileIntoKVMemoryStore()
+	if err == nil {
 		return
 	}
 
-	for i := 0; i < len(data); i += 2 {
-		key := data[i]
-		value := data[i+1]
-		SETsMu.Lock()
-		SETs[key] = &Entry{
-			Value:       value,
-			TimeCreated: time.Now(),
-			ExpiryInMS:  time.Time{},
-		}
-		SETsMu.Unlock()
+	path := rdbPath()
+	var indexErr *rdbDBIndexError
+	if errors.As(err, &indexErr) {
+		logger.Fatal("Failed loading RDB file %s: %s", path, err.Error())
+	}
+	ConfigsMu.RLock()
+	policy := Configs["rdb-load-corrupt"]
+	ConfigsMu.RUnlock()
+	if policy != RdbCorruptRename {
+		logger.Fatal("Failed loading RDB file %s: %s. Fix or remove the file, or start with rdb-load-corrupt rename", path, err.Error())
 	}
 
-	//length, err := decodeLength(reader)
-	//for i := range length {
-	//	key := make([]byte, line[3])
-	//	value := line[5+line[3]:]
-	//
-	//	SETsMu.Lock()
-	//	SETs[string(key)] = &Entry{
-	//		Value:       string(value),
-	//		TimeCreated: time.Now(),
-	//		ExpiryInMS:  time.Time{},
-	//	}
-	//	defer SETsMu.Unlock()
-	//}
+	aside := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	if renameErr := os.Rename(path, aside); renameErr != nil {
+		logger.Fatal("Failed loading RDB file %s: %s, and failed to move it aside: %s", path, err.Error(), renameErr.Error())
+	}
+	logger.Warning("RDB file %s is corrupt (%s), moved it to %s and starting with an empty dataset", path, err.Error(), aside)
+}
+
+// quicklist 节点的容器类型
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// rdbKey 从 RDB 中解析出的一个 key，value 和 Entry.Value 使用相同的表示方式
+type rdbKey struct {
+	db     int
+	key    string
+	typ    byte
+	value  any
+	expiry time.Time
+}
 
+// rdbDecoder 流式读取 RDB 文件，同时计算读过的内容的 CRC64
+type rdbDecoder struct {
+	r   *bufio.Reader
+	crc uint64
 }
 
-func parseRDB(content []byte) ([]string, error) {
-	var result []string
-	line := parseTable(content)
-	reader := bytes.NewReader(line)
+// errRdbChecksum 文件内容和末尾的 CRC64 不一致
+var errRdbChecksum = errors.New("wrong RDB checksum, the file is corrupt")
 
+// parseRDB 流式解析 RDB 文件，每读出一个 key 调用一次 callback。
+// verify 为 true 时校验文件末尾的 CRC64，校验和为 0 表示写入时关闭了校验，跳过
+func parseRDB(r *bufio.Reader, verify bool, callback func(key rdbKey) error) error {
+	d := &rdbDecoder{r: r}
+
+	header := make([]byte, 9)
+	if err := d.readFull(header); err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxSupportedVersion {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	db := 0
+	var expiry time.Time
 	for {
-		opcode, err := reader.ReadByte()
+		opcode, err := d.readByte()
 		if err != nil {
-			return result, err
+			return err
 		}
 
 		switch opcode {
 		case opCodeSelectDB:
-			// Follwing byte(s) is the db number.
-			dbNum, err := decodeLength(reader)
+			// Following byte(s) is the db number.
+			dbNum, err := d.readLength()
 			if err != nil {
-				return result, err
+				return err
+			}
+			if dbNum > math.MaxInt32 {
+				return fmt.Errorf("invalid DB index %d", dbNum)
+			}
+			db = int(dbNum)
+			logger.Debug("DB number: %d", db)
+		case opCodeResizeDB:
+			// 哈希表大小和过期哈希表大小，只是提示，不需要使用
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+		case opCodeSlotInfo:
+			// slot id, slot size, expires slot size
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLength(); err != nil {
+					return err
+				}
 			}
-			logger.Debug("DB number: " + strconv.Itoa(dbNum))
 		case opCodeAux:
 			// Length prefixed key and value strings follow.
-			kv := [][]byte{}
-			for i := 0; i < 2; i++ {
-				length, err := decodeLength(reader)
-				if err != nil {
-					return result, err
-				}
-				data := make([]byte, int(length))
-				if _, err = reader.Read(data); err != nil {
-					return result, err
-				}
-				kv = append(kv, data)
+			key, err := d.readString()
+			if err != nil {
+				return err
 			}
-		case opCodeResizeDB:
-			// Implement
-			hashTableNum, err := decodeLength(reader)
+			value, err := d.readString()
 			if err != nil {
-				return result, err
-			}
-			_, _ = reader.ReadByte()
-			logger.Debug("Hash table resize: " + strconv.Itoa(hashTableNum))
-		case opCodeTypeString:
-			kv := [][]byte{}
-			for i := 0; i < 2; i++ {
-				length, err := decodeLength(reader)
-				if err != nil {
-					return result, err
-				}
-				data := make([]byte, int(length))
-				if _, err = reader.Read(data); err != nil {
-					return result, err
-				}
-				kv = append(kv, data)
+				return err
 			}
-			result = append(result, string(kv[0]), string(kv[1]))
+			logger.Debug("RDB aux field %s: %s", key, value)
+		case opCodeFunction2:
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			logger.Warning("skipping function library in RDB, functions are not supported")
+		case opCodeExpireTimeMs:
+			ms, err := d.readUint64()
+			if err != nil {
+				return err
+			}
+			expiry = time.UnixMilli(int64(ms))
+		case opCodeExpireTime:
+			buf := make([]byte, 4)
+			if err := d.readFull(buf); err != nil {
+				return err
+			}
+			expiry = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+		case opCodeIdle:
+			// LRU 空闲时间，忽略
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+		case opCodeFreq:
+			// LFU 访问频率，忽略
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		case opCodeModuleAux, opCodeFunctionPreGA:
+			return fmt.Errorf("unsupported RDB opcode %d", opcode)
 		case opCodeEOF:
 			// Get the 8-byte checksum after this
-			checksum := make([]byte, 8)
-			_, err := reader.Read(checksum)
+			if version < 5 {
+				return nil
+			}
+			expected := d.crc
+			checksum, err := d.readUint64()
 			if err != nil {
-				return result, err
+				return err
+			}
+			if verify && checksum != 0 && checksum != expected {
+				return errRdbChecksum
 			}
-			return result, nil
+			return nil
 		default:
-			// Handle any other tags.
+			// 其余的 opcode 都是值类型，后面依次是 key 和 value
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readObject(opcode)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			if err := callback(rdbKey{db: db, key: key, typ: opcode, value: value, expiry: expiry}); err != nil {
+				return err
+			}
+			expiry = time.Time{}
 		}
 	}
 }
 
-func decodeLength(r *bytes.Reader) (int, error) {
-	num, err := r.ReadByte()
+func (d *rdbDecoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return 0, err
 	}
+	d.crc = crc64Update(d.crc, []byte{b})
+	return b, nil
+}
 
-	switch {
-	case num <= 63: // leading bits 00
+func (d *rdbDecoder) readFull(buf []byte) error {
+	_, err := io.ReadFull(d.r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	d.crc = crc64Update(d.crc, buf)
+	return nil
+}
+
+// Write 让 rdbDecoder 可以作为 io.Writer，用于在 io.CopyN 时计算 CRC64
+func (d *rdbDecoder) Write(p []byte) (int, error) {
+	d.crc = crc64Update(d.crc, p)
+	return len(p), nil
+}
+
+func (d *rdbDecoder) readUint64() (uint64, error) {
+	buf := make([]byte, 8)
+	if err := d.readFull(buf); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// readLengthWithEncoding 读取长度编码，encoded 为 true 时表示是特殊编码（0b11 开头），
+// 此时返回值是编码类型而不是长度
+func (d *rdbDecoder) readLengthWithEncoding() (length uint64, encoded bool, err error) {
+	num, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch num >> 6 {
+	case 0b00:
 		// Remaining 6 bits are the length.
-		return int(num & 0b00111111), nil
-	case num <= 127: // leading bits 01
+		return uint64(num & 0b00111111), false, nil
+	case 0b01:
 		// Remaining 6 bits plus next byte are the length
-		nextNum, err := r.ReadByte()
+		next, err := d.readByte()
 		if err != nil {
-			return 0, err
+			return 0, false, err
 		}
-		length := binary.BigEndian.Uint16([]byte{num & 0b00111111, nextNum})
-		return int(length), nil
-	case num <= 191: // leading bits 10
-		// Next 4 bytes are the length
-		bytes := make([]byte, 4)
-		_, err := r.Read(bytes)
-		if err != nil {
-			return 0, err
+		return uint64(num&0b00111111)<<8 | uint64(next), false, nil
+	case 0b10:
+		switch num {
+		case 0x80: // Next 4 bytes are the length
+			buf := make([]byte, 4)
+			if err := d.readFull(buf); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81: // Next 8 bytes are the length
+			buf := make([]byte, 8)
+			if err := d.readFull(buf); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		default:
+			return 0, false, fmt.Errorf("unknown length encoding %#x", num)
 		}
-		length := binary.BigEndian.Uint32(bytes)
-		return int(length), nil
-	case num <= 255: // leading bits 11
+	default:
 		// Next 6 bits indicate the format of the encoded object.
-		// TODO: This will result in problems on the next read, possibly.
-		valueType := num & 0b00111111
-		return int(valueType), nil
+		return uint64(num & 0b00111111), true, nil
+	}
+}
+
+func (d *rdbDecoder) readLength() (uint64, error) {
+	length, encoded, err := d.readLengthWithEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errors.New("unexpected encoded length")
+	}
+	return length, nil
+}
+
+// 字符串的特殊编码
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// readString 读取字符串，支持整数编码和 LZF 压缩
+func (d *rdbDecoder) readString() (string, error) {
+	length, encoded, err := d.readLengthWithEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		return d.readRaw(length)
+	}
+
+	switch length {
+	case rdbEncInt8:
+		b, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b))), nil
+	case rdbEncInt16:
+		buf := make([]byte, 2)
+		if err := d.readFull(buf); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf := make([]byte, 4)
+		if err := d.readFull(buf); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		compressedLen, err := d.readLength()
+		if err != nil {
+			return "", err
+		}
+		rawLen, err := d.readLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := d.readRaw(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		// 解压后的长度来自文件，转换成 int 之前先检查范围
+		if rawLen > math.MaxInt {
+			return "", fmt.Errorf("LZF uncompressed length %d out of range", rawLen)
+		}
+		raw, err := lzfDecompress([]byte(compressed), int(rawLen))
+		if err != nil {
+			return "", err
+		}
+		return string(raw), nil
 	default:
+		return "", fmt.Errorf("unknown string encoding %d", length)
+	}
+}
+
+// rdbMaxPrealloc 根据文件中的长度预分配内存的上限，防止损坏的长度导致一次性分配过多内存
+const rdbMaxPrealloc = 1 << 20
+
+func preallocSize(count uint64) int {
+	if count > rdbMaxPrealloc {
+		return rdbMaxPrealloc
+	}
+	return int(count)
+}
+
+func (d *rdbDecoder) readRaw(length uint64) (string, error) {
+	if length <= rdbMaxPrealloc {
+		buf := make([]byte, length)
+		if err := d.readFull(buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+	var sb strings.Builder
+	n, err := io.CopyN(io.MultiWriter(&sb, d), d.r, int64(length))
+	if err != nil || uint64(n) != length {
+		return "", io.ErrUnexpectedEOF
+	}
+	return sb.String(), nil
+}
+
+// readDouble 读取 ZSET 版本 1 中以字符串保存的 double
+func (d *rdbDecoder) readDouble() (float64, error) {
+	length, err := d.readByte()
+	if err != nil {
 		return 0, err
 	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, length)
+	if err := d.readFull(buf); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+func (d *rdbDecoder) readStrings(count uint64) ([]string, error) {
+	values := make([]string, 0, preallocSize(count))
+	for i := uint64(0); i < count; i++ {
+		value, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// readObject 按值类型读取 value
+func (d *rdbDecoder) readObject(typ byte) (any, error) {
+	switch typ {
+	case opCodeTypeString:
+		value, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(value), nil
+	case opCodeTypeList:
+		length, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return d.readStrings(length)
+	case opCodeTypeSet:
+		length, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return toSet(d.readStrings(length))
+	case opCodeTypeZSet, opCodeTypeZSet2:
+		length, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		members := make(map[string]float64, preallocSize(length))
+		for i := uint64(0); i < length; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == opCodeTypeZSet2 {
+				bits, err := d.readUint64()
+				if err != nil {
+					return nil, err
+				}
+				score = math.Float64frombits(bits)
+			} else if score, err = d.readDouble(); err != nil {
+				return nil, err
+			}
+			members[member] = score
+		}
+		return members, nil
+	case opCodeTypeHash:
+		length, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		values, err := d.readStrings(length * 2)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(values)
+	case opCodeTypeListQuicklist, opCodeTypeListQuicklist2:
+		nodes, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		for i := uint64(0); i < nodes; i++ {
+			container := uint64(quicklistNodePacked)
+			if typ == opCodeTypeListQuicklist2 {
+				if container, err = d.readLength(); err != nil {
+					return nil, err
+				}
+			}
+			node, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case container == quicklistNodePlain:
+				values = append(values, node)
+			case typ == opCodeTypeListQuicklist:
+				entries, err := decodeZiplist([]byte(node))
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, entries...)
+			default:
+				entries, err := decodeListpack([]byte(node))
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, entries...)
+			}
+		}
+		return values, nil
+	}
+
+	// 其余类型都以一个字符串保存编码后的数据
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case opCodeTypeHashZipmap:
+		values, err := decodeZipmap([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(values)
+	case opCodeTypeListZiplist:
+		return decodeZiplist([]byte(blob))
+	case opCodeTypeSetIntset:
+		return toSet(decodeIntset([]byte(blob)))
+	case opCodeTypeSetListpack:
+		return toSet(decodeListpack([]byte(blob)))
+	case opCodeTypeZSetZiplist, opCodeTypeZSetListpack:
+		decode := decodeZiplist
+		if typ == opCodeTypeZSetListpack {
+			decode = decodeListpack
+		}
+		values, err := decode([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return pairsToZSet(values)
+	case opCodeTypeHashZiplist, opCodeTypeHashListpack:
+		decode := decodeZiplist
+		if typ == opCodeTypeHashListpack {
+			decode = decodeListpack
+		}
+		values, err := decode([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(values)
+	default:
+		return nil, fmt.Errorf("unsupported RDB value type %d", typ)
+	}
+}
+
+func pairsToHash(values []string) (*Hash, error) {
+	if len(values)%2 != 0 {
+		return nil, errors.New("hash with odd number of elements")
+	}
+	hash := newHash(len(values) / 2)
+	for i := 0; i < len(values); i += 2 {
+		hash.set(values[i], []byte(values[i+1]))
+	}
+	return hash, nil
+}
+
+func pairsToZSet(values []string) (map[string]float64, error) {
+	if len(values)%2 != 0 {
+		return nil, errors.New("zset with odd number of elements")
+	}
+	members := make(map[string]float64, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zset score %q", values[i+1])
+		}
+		members[values[i]] = score
+	}
+	return members, nil
+}
+
+func toSet(values []string, err error) (map[string]struct{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set, nil
+}
+
+// -------------------------------- RDB 写入 --------------------------------
+
+// crc64Table Redis 使用的 Jones CRC64（反射多项式 0x95ac9329ac4bc9b5，初值 0，无结果异或）
+var crc64Table = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ 0x95ac9329ac4bc9b5
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc64Update(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// rdbEncoder 按 RDB 格式写出数据，同时计算 CRC64
+type rdbEncoder struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func (e *rdbEncoder) write(data []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc = crc64Update(e.crc, data)
+	_, e.err = e.w.Write(data)
+}
+
+func (e *rdbEncoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+// writeLength 长度编码，和 readLengthWithEncoding 对应
+func (e *rdbEncoder) writeLength(length uint64) {
+	switch {
+	case length <= 63: // 00 + 6 bits
+		e.writeByte(byte(length))
+	case length <= 16383: // 01 + 14 bits
+		e.write([]byte{byte(length>>8) | 0b01000000, byte(length)})
+	case length <= 0xFFFFFFFF: // 10000000 + 4 bytes
+		buf := make([]byte, 5)
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		e.write(buf)
+	default: // 10000001 + 8 bytes
+		buf := make([]byte, 9)
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], length)
+		e.write(buf)
+	}
+}
+
+func (e *rdbEncoder) writeString(str string) {
+	e.writeLength(uint64(len(str)))
+	e.write([]byte(str))
+}
+
+// writeDatabase 写入一个数据库的 SELECTDB、RESIZEDB 和所有 key，已经过期的 key 不写入
+func (e *rdbEncoder) writeDatabase(db int, data map[string]*Entry, now time.Time) {
+	size, expires := 0, 0
+	for _, entry := range data {
+		if !entry.expired(now) {
+			size++
+			if (entry.ExpiryInMS != time.Time{}) {
+				expires++
+			}
+		}
+	}
+	if size == 0 {
+		return
+	}
+
+	e.writeByte(opCodeSelectDB)
+	e.writeLength(uint64(db))
+	e.writeByte(opCodeResizeDB)
+	e.writeLength(uint64(size))
+	e.writeLength(uint64(expires))
+
+	for key, entry := range data {
+		if entry.expired(now) {
+			continue
+		}
+		if (entry.ExpiryInMS != time.Time{}) {
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, uint64(entry.ExpiryInMS.UnixMilli()))
+			e.writeByte(opCodeExpireTimeMs)
+			e.write(buf)
+		}
+		e.writeObject(key, entry)
+	}
 }
 
-func sliceIndex(data []byte, sep byte) int {
-	for i, b := range data {
-		if b == sep {
-			return i
+// writeObject 写入值类型、key 和 value，所有类型都使用不压缩的编码
+func (e *rdbEncoder) writeObject(key string, entry *Entry) {
+	switch value := entry.Value.(type) {
+	case []byte:
+		e.writeByte(opCodeTypeString)
+		e.writeString(key)
+		e.writeString(string(value))
+	case *Hash:
+		e.writeByte(opCodeTypeHash)
+		e.writeString(key)
+		e.writeLength(uint64(len(value.Fields)))
+		for field, v := range value.Fields {
+			e.writeString(field)
+			e.writeString(string(v))
+		}
+	case []string:
+		e.writeByte(opCodeTypeList)
+		e.writeString(key)
+		e.writeLength(uint64(len(value)))
+		for _, item := range value {
+			e.writeString(item)
+		}
+	case map[string]struct{}:
+		e.writeByte(opCodeTypeSet)
+		e.writeString(key)
+		e.writeLength(uint64(len(value)))
+		for member := range value {
+			e.writeString(member)
+		}
+	case map[string]float64:
+		e.writeByte(opCodeTypeZSet2)
+		e.writeString(key)
+		e.writeLength(uint64(len(value)))
+		buf := make([]byte, 8)
+		for member, score := range value {
+			e.writeString(member)
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(score))
+			e.write(buf)
 		}
 	}
-	return -1
 }
-func parseTable(bytes []byte) []byte {
-	start := sliceIndex(bytes, opCodeResizeDB)
-	end := sliceIndex(bytes, opCodeEOF)
-	return bytes[start:end]
+
+func (e *rdbEncoder) writeAux(key, value string) {
+	e.writeByte(opCodeAux)
+	e.writeString(key)
+	e.writeString(value)
+}
+
+// writeRDB 把快照按 RDB 格式写入 w：头部、aux 字段、每个非空数据库的所有 key，最后是 EOF 和 CRC64
+func writeRDB(w io.Writer, dbs []map[string]*Entry, now time.Time) error {
+	e := &rdbEncoder{w: w}
+	e.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	e.writeAux("redis-ver", redisVersion)
+	e.writeAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	e.writeAux("ctime", strconv.FormatInt(now.Unix(), 10))
+	e.writeAux("aof-base", "0")
+
+	for db, data := range dbs {
+		e.writeDatabase(db, data, now)
+	}
+
+	e.writeByte(opCodeEOF)
+	if e.err != nil {
+		return e.err
+	}
+	// rdbchecksum no 时写入 0，加载时会跳过校验
+	ConfigsMu.RLock()
+	withChecksum := Configs["rdbchecksum"] != "no"
+	ConfigsMu.RUnlock()
+	checksum := make([]byte, 8)
+	if withChecksum {
+		binary.LittleEndian.PutUint64(checksum, e.crc)
+	}
+	_, err := w.Write(checksum)
+	return err
+}
+
+// rdbState 记录快照的状态
+var rdbState = struct {
+	mu           sync.Mutex
+	saveMu       sync.Mutex    // 保证同一时间只有一个保存在写临时文件
+	bgsaving     bool          // 是否有 BGSAVE 在进行
+	lastSave     time.Time     // 上次成功保存的时间
+	lastTry      time.Time     // 上次尝试 BGSAVE 的时间
+	lastStatusOK bool          // 上次 BGSAVE 是否成功
+	lastDuration time.Duration // 上次保存耗时，还没有保存过时为 -1
+}{lastSave: time.Now(), lastStatusOK: true, lastDuration: -1}
+
+// dirty 上次保存之后数据被修改的次数，由所有修改数据的命令累加
+var dirty atomic.Int64
+
+// bgsaveRetryDelay 上次 BGSAVE 失败后，自动保存至少间隔这么久再重试
+const bgsaveRetryDelay = 5 * time.Second
+
+// rdbSnapshot 某一时刻的数据副本，以及当时的 dirty 计数
+type rdbSnapshot struct {
+	dbs   []map[string]*Entry
+	dirty int64
+}
+
+func takeRdbSnapshot() rdbSnapshot {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	// 先读 dirty 再复制数据，两者之间（例如主动过期）的修改会在下次保存时再算一次，宁多勿少
+	d := dirty.Load()
+	return rdbSnapshot{dbs: snapshotDatabases(), dirty: d}
+}
+
+var errBgsaveInProgress = errors.New("Background save already in progress")
+
+// rdbSave 把快照写到临时文件，fsync 后再 rename 成 dbfilename，保证 dump 文件要么是旧的要么是完整的新文件
+func rdbSave(snapshot rdbSnapshot) error {
+	rdbState.saveMu.Lock()
+	defer rdbState.saveMu.Unlock()
+
+	start := time.Now()
+	path := rdbPath()
+	tempPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	writer := bufio.NewWriter(file)
+	if err = writeRDB(writer, snapshot.dbs, start); err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		logger.Error("Failed saving the DB: %s", err.Error())
+		return err
+	}
+
+	dirty.Add(-snapshot.dirty)
+	rdbState.mu.Lock()
+	rdbState.lastSave = time.Now()
+	rdbState.lastDuration = time.Since(start)
+	rdbState.mu.Unlock()
+	logger.Info("DB saved on disk: %s", path)
+	return nil
 }
-func readFile(path string) string {
-	c, _ := os.ReadFile(path)
-	key := parseTable(c)
-	str := key[4 : 4+key[3]]
-	return string(str)
+
+// rdbSaveBackground 在后台 goroutine 中保存快照，快照在调用时同步生成
+func rdbSaveBackground() error {
+	rdbState.mu.Lock()
+	if rdbState.bgsaving {
+		rdbState.mu.Unlock()
+		return errBgsaveInProgress
+	}
+	rdbState.bgsaving = true
+	rdbState.lastTry = time.Now()
+	rdbState.mu.Unlock()
+
+	snapshot := takeRdbSnapshot()
+	go func() {
+		err := rdbSave(snapshot)
+		rdbState.mu.Lock()
+		rdbState.bgsaving = false
+		rdbState.lastStatusOK = err == nil
+		rdbState.mu.Unlock()
+	}()
+	return nil
+}
+
+// saveRule save <seconds> <changes>：距离上次保存超过 seconds 秒且至少有 changes 次修改时自动保存
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+// parseSaveRules 解析 "900 1 300 10" 这样的规则列表，空字符串表示关闭自动保存
+func parseSaveRules(value string) ([]saveRule, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid save parameters")
+	}
+	var rules []saveRule
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+	return rules, nil
+}
+
+// rdbSaveIfNeeded 任意一条 save 规则满足时触发一次 BGSAVE，由定时任务每秒调用
+func rdbSaveIfNeeded() {
+	ConfigsMu.RLock()
+	rules, _ := parseSaveRules(Configs["save"])
+	ConfigsMu.RUnlock()
+
+	rdbState.mu.Lock()
+	bgsaving, lastSave, lastTry, lastStatusOK := rdbState.bgsaving, rdbState.lastSave, rdbState.lastTry, rdbState.lastStatusOK
+	rdbState.mu.Unlock()
+	if bgsaving {
+		return
+	}
+
+	now, changes := time.Now(), dirty.Load()
+	for _, rule := range rules {
+		if changes < rule.changes || now.Sub(lastSave) < time.Duration(rule.seconds)*time.Second {
+			continue
+		}
+		// 上次失败的话等一会再重试，避免磁盘出问题时不停地保存
+		if !lastStatusOK && now.Sub(lastTry) < bgsaveRetryDelay {
+			continue
+		}
+		logger.Info("%d changes in %d seconds. Saving...", rule.changes, rule.seconds)
+		_ = rdbSaveBackground()
+		return
+	}
+}
+
+// persistenceInfo INFO persistence 的内容
+func persistenceInfo() string {
+	rdbState.mu.Lock()
+	bgsaving, lastSave, lastStatusOK, lastDuration := rdbState.bgsaving, rdbState.lastSave, rdbState.lastStatusOK, rdbState.lastDuration
+	rdbState.mu.Unlock()
+
+	status := "ok"
+	if !lastStatusOK {
+		status = "err"
+	}
+	durationSec, durationMs := int64(-1), int64(-1)
+	if lastDuration >= 0 {
+		durationSec, durationMs = int64(lastDuration.Seconds()), lastDuration.Milliseconds()
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# Persistence\r\n")
+	sb.WriteString("loading:0\r\n")
+	sb.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", dirty.Load()))
+	sb.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", boolToInt(bgsaving)))
+	sb.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", lastSave.Unix()))
+	sb.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", status))
+	sb.WriteString(fmt.Sprintf("rdb_last_bgsave_time_sec:%d\r\n", durationSec))
+	sb.WriteString(fmt.Sprintf("rdb_last_save_duration_ms:%d\r\n", durationMs))
+	sb.WriteString(fmt.Sprintf("aof_enabled:%d\r\n", boolToInt(AOF != nil)))
+	return sb.String()
+}
+
+func save(sc *ServerConnection, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'save' command"}
+	}
+	rdbState.mu.Lock()
+	bgsaving := rdbState.bgsaving
+	rdbState.mu.Unlock()
+	if bgsaving {
+		return Value{typ: ERROR, str: "ERR " + errBgsaveInProgress.Error()}
+	}
+	if err := rdbSave(takeRdbSnapshot()); err != nil {
+		return Value{typ: ERROR, str: "ERR " + err.Error()}
+	}
+	return Value{typ: STRING, str: "OK"}
+}
+
+func bgSave(sc *ServerConnection, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'bgsave' command"}
+	}
+	if err := rdbSaveBackground(); err != nil {
+		return Value{typ: ERROR, str: "ERR " + err.Error()}
+	}
+	return Value{typ: STRING, str: "Background saving started"}
+}
+
+func lastSave(sc *ServerConnection, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'lastsave' command"}
+	}
+	rdbState.mu.Lock()
+	defer rdbState.mu.Unlock()
+	return Value{typ: INTEGER, num: int(rdbState.lastSave.Unix())}
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RDB 中紧凑编码（LZF、ziplist、listpack、intset、zipmap）的解码
+
+var errCorruptEncoding = errors.New("corrupt compact encoding")
+
+// lzfDecompress 解压 LZF 数据，rawLen 是文件中记录的解压后的长度。
+// rawLen 不可信，预分配受 preallocSize 限制，解压出的数据超过 rawLen 时立即报错
+func lzfDecompress(in []byte, rawLen int) ([]byte, error) {
+	out := make([]byte, 0, preallocSize(uint64(rawLen)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// 字面量：后面 ctrl+1 个字节原样复制
+			length := ctrl + 1
+			if i+length > len(in) || len(out)+length > rawLen {
+				return nil, errors.New("corrupt LZF data")
+			}
+			out = append(out, in[i:i+length]...)
+			i += length
+			continue
+		}
+
+		// 回溯引用：从已经解压的数据中复制
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("corrupt LZF data")
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+length+2 > rawLen {
+			return nil, errors.New("corrupt LZF data")
+		}
+		// 引用区域可能和正在写入的区域重叠，只能逐字节复制
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != rawLen {
+		return nil, fmt.Errorf("LZF length mismatch: expected %d, got %d", rawLen, len(out))
+	}
+	return out, nil
+}
+
+// decodeZiplist 解码 ziplist：zlbytes(4) zltail(4) zllen(2) entries... 0xFF
+func decodeZiplist(data []byte) ([]string, error) {
+	if len(data) < 11 {
+		return nil, errCorruptEncoding
+	}
+	var values []string
+	pos := 10
+	for {
+		if pos >= len(data) {
+			return nil, errCorruptEncoding
+		}
+		if data[pos] == 0xFF {
+			return values, nil
+		}
+
+		// prevlen：1 个字节，或者 0xFE 加 4 个字节
+		if data[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, errCorruptEncoding
+		}
+
+		encoding := data[pos]
+		var value string
+		var size int
+		switch encoding >> 6 {
+		case 0b00: // 6 位长度的字符串
+			size = 1 + int(encoding&0x3f)
+			if pos+size > len(data) {
+				return nil, errCorruptEncoding
+			}
+			value = string(data[pos+1 : pos+size])
+		case 0b01: // 14 位长度的字符串
+			if pos+2 > len(data) {
+				return nil, errCorruptEncoding
+			}
+			size = 2 + (int(encoding&0x3f)<<8 | int(data[pos+1]))
+			if pos+size > len(data) {
+				return nil, errCorruptEncoding
+			}
+			value = string(data[pos+2 : pos+size])
+		case 0b10: // 32 位长度的字符串
+			if pos+5 > len(data) {
+				return nil, errCorruptEncoding
+			}
+			size = 5 + int(binary.BigEndian.Uint32(data[pos+1:pos+5]))
+			if size < 5 || pos+size > len(data) {
+				return nil, errCorruptEncoding
+			}
+			value = string(data[pos+5 : pos+size])
+		default: // 整数
+			var n int64
+			var err error
+			n, size, err = decodeZiplistInt(data[pos:])
+			if err != nil {
+				return nil, err
+			}
+			value = strconv.FormatInt(n, 10)
+		}
+		values = append(values, value)
+		pos += size
+	}
+}
+
+// decodeZiplistInt 解码 ziplist 的整数 entry，返回值和 entry 中编码加数据占用的字节数
+func decodeZiplistInt(data []byte) (int64, int, error) {
+	encoding := data[0]
+	need := map[byte]int{0xC0: 2, 0xD0: 4, 0xE0: 8, 0xF0: 3, 0xFE: 1}[encoding]
+	if len(data) < 1+need {
+		return 0, 0, errCorruptEncoding
+	}
+	switch encoding {
+	case 0xC0:
+		return int64(int16(binary.LittleEndian.Uint16(data[1:]))), 3, nil
+	case 0xD0:
+		return int64(int32(binary.LittleEndian.Uint32(data[1:]))), 5, nil
+	case 0xE0:
+		return int64(binary.LittleEndian.Uint64(data[1:])), 9, nil
+	case 0xF0:
+		n := int32(uint32(data[1]) | uint32(data[2])<<8 | uint32(data[3])<<16)
+		return int64(n<<8) >> 8, 4, nil
+	case 0xFE:
+		return int64(int8(data[1])), 2, nil
+	}
+	// 1111xxxx：xxxx 为 0001 到 1101，表示 0 到 12
+	if encoding >= 0xF1 && encoding <= 0xFD {
+		return int64(encoding&0x0f) - 1, 1, nil
+	}
+	return 0, 0, errCorruptEncoding
+}
+
+// decodeListpack 解码 listpack：total-bytes(4) num-elements(2) entries... 0xFF，
+// 每个 entry 由编码、数据和 backlen 组成
+func decodeListpack(data []byte) ([]string, error) {
+	if len(data) < 7 {
+		return nil, errCorruptEncoding
+	}
+	var values []string
+	pos := 6
+	for {
+		if pos >= len(data) {
+			return nil, errCorruptEncoding
+		}
+		encoding := data[pos]
+		if encoding == 0xFF {
+			return values, nil
+		}
+
+		var value string
+		var size int
+		need := func(n int) bool { return pos+n <= len(data) }
+		switch {
+		case encoding>>7 == 0: // 0xxxxxxx 7 位无符号整数
+			value, size = strconv.Itoa(int(encoding)), 1
+		case encoding>>6 == 0b10: // 10xxxxxx 6 位长度的字符串
+			size = 1 + int(encoding&0x3f)
+			if !need(size) {
+				return nil, errCorruptEncoding
+			}
+			value = string(data[pos+1 : pos+size])
+		case encoding>>5 == 0b110: // 110xxxxx 13 位有符号整数
+			if !need(2) {
+				return nil, errCorruptEncoding
+			}
+			n := int(encoding&0x1f)<<8 | int(data[pos+1])
+			if n >= 1<<12 {
+				n -= 1 << 13
+			}
+			value, size = strconv.Itoa(n), 2
+		case encoding>>4 == 0b1110: // 1110xxxx 12 位长度的字符串
+			if !need(2) {
+				return nil, errCorruptEncoding
+			}
+			size = 2 + (int(encoding&0x0f)<<8 | int(data[pos+1]))
+			if !need(size) {
+				return nil, errCorruptEncoding
+			}
+			value = string(data[pos+2 : pos+size])
+		case encoding == 0xF0: // 32 位长度的字符串
+			if !need(5) {
+				return nil, errCorruptEncoding
+			}
+			size = 5 + int(binary.LittleEndian.Uint32(data[pos+1:]))
+			if size < 5 || !need(size) {
+				return nil, errCorruptEncoding
+			}
+			value = string(data[pos+5 : pos+size])
+		case encoding >= 0xF1 && encoding <= 0xF4: // 16/24/32/64 位有符号整数
+			width := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[encoding]
+			if !need(1 + width) {
+				return nil, errCorruptEncoding
+			}
+			var u uint64
+			for i := width - 1; i >= 0; i-- {
+				u = u<<8 | uint64(data[pos+1+i])
+			}
+			// 符号扩展
+			shift := uint(64 - width*8)
+			value, size = strconv.FormatInt(int64(u<<shift)>>shift, 10), 1+width
+		default:
+			return nil, errCorruptEncoding
+		}
+		values = append(values, value)
+		pos += size + listpackBacklenSize(size)
+	}
+}
+
+// listpackBacklenSize backlen 保存 entry 的长度，每个字节保存 7 位
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// decodeIntset 解码 intset：encoding(4) length(4) 小端的整数数组
+func decodeIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, errCorruptEncoding
+	}
+	width := int(binary.LittleEndian.Uint32(data[0:4]))
+	length := int(binary.LittleEndian.Uint32(data[4:8]))
+	if (width != 2 && width != 4 && width != 8) || len(data) < 8+width*length {
+		return nil, errCorruptEncoding
+	}
+	values := make([]string, 0, length)
+	for i := 0; i < length; i++ {
+		item := data[8+i*width:]
+		var n int64
+		switch width {
+		case 2:
+			n = int64(int16(binary.LittleEndian.Uint16(item)))
+		case 4:
+			n = int64(int32(binary.LittleEndian.Uint32(item)))
+		case 8:
+			n = int64(binary.LittleEndian.Uint64(item))
+		}
+		values = append(values, strconv.FormatInt(n, 10))
+	}
+	return values, nil
+}
+
+// decodeZipmap 解码老版本 hash 使用的 zipmap：zmlen(1) (len key len free value)... 0xFF
+func decodeZipmap(data []byte) ([]string, error) {
+	if len(data) < 2 {
+		return nil, errCorruptEncoding
+	}
+	var values []string
+	pos := 1
+	readLen := func() (int, bool) {
+		if pos >= len(data) {
+			return 0, false
+		}
+		switch b := data[pos]; {
+		case b < 254:
+			pos++
+			return int(b), true
+		case b == 254:
+			if pos+5 > len(data) {
+				return 0, false
+			}
+			n := int(binary.LittleEndian.Uint32(data[pos+1:]))
+			pos += 5
+			return n, true
+		default:
+			return 0, false
+		}
+	}
+	for {
+		if pos >= len(data) {
+			return nil, errCorruptEncoding
+		}
+		if data[pos] == 0xFF {
+			return values, nil
+		}
+
+		keyLen, ok := readLen()
+		if !ok || pos+keyLen > len(data) {
+			return nil, errCorruptEncoding
+		}
+		key := string(data[pos : pos+keyLen])
+		pos += keyLen
+
+		valueLen, ok := readLen()
+		if !ok || pos+1+valueLen > len(data) {
+			return nil, errCorruptEncoding
+		}
+		free := int(data[pos])
+		pos++
+		value := string(data[pos : pos+valueLen])
+		pos += valueLen + free
+		values = append(values, key, value)
+	}
+}
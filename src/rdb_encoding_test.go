@@ -0,0 +1,257 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLzfDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		rawLen  int
+		want    string
+		wantErr bool
+	}{
+		{name: "literal", in: []byte{2, 'a', 'b', 'c'}, rawLen: 3, want: "abc"},
+		// 一个字面量 a，再从距离 1 的位置重叠复制 4 个字节
+		{name: "back reference", in: []byte{0, 'a', 0x40, 0x00}, rawLen: 5, want: "aaaaa"},
+		// 长度 7 表示后面还有一个字节的额外长度：7+1+2 = 10
+		{name: "long back reference", in: []byte{0, 'x', 0xe0, 0x01, 0x00}, rawLen: 11, want: "xxxxxxxxxxx"},
+		{name: "empty", in: nil, rawLen: 0, want: ""},
+		{name: "truncated literal", in: []byte{5, 'a', 'b'}, rawLen: 6, wantErr: true},
+		{name: "truncated back reference length", in: []byte{0, 'a', 0xe0}, rawLen: 10, wantErr: true},
+		{name: "truncated back reference offset", in: []byte{0, 'a', 0x40}, rawLen: 5, wantErr: true},
+		{name: "reference before start", in: []byte{0, 'a', 0x40, 0x05}, rawLen: 5, wantErr: true},
+		{name: "literal longer than rawLen", in: []byte{2, 'a', 'b', 'c'}, rawLen: 2, wantErr: true},
+		{name: "reference longer than rawLen", in: []byte{0, 'a', 0x40, 0x00}, rawLen: 3, wantErr: true},
+		{name: "shorter than rawLen", in: []byte{2, 'a', 'b', 'c'}, rawLen: 4, wantErr: true},
+		{name: "huge rawLen", in: []byte{2, 'a', 'b', 'c'}, rawLen: math.MaxInt, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lzfDecompress(tt.in, tt.rawLen)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lzfDecompress() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lzfDecompress() error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("lzfDecompress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// ziplist 加上 10 个字节的头部和结尾的 0xFF，头部的内容解码时不使用
+func ziplist(entries ...byte) []byte {
+	data := make([]byte, 10, 11+len(entries))
+	data = append(data, entries...)
+	return append(data, 0xff)
+}
+
+func TestDecodeZiplist(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", data: ziplist(), want: nil},
+		{name: "6 bit string", data: ziplist(0x00, 0x02, 'a', 'b'), want: []string{"ab"}},
+		{name: "14 bit string", data: ziplist(0x00, 0x40, 0x03, 'a', 'b', 'c'), want: []string{"abc"}},
+		{name: "32 bit string", data: ziplist(0x00, 0x80, 0, 0, 0, 2, 'h', 'i'), want: []string{"hi"}},
+		{name: "large prevlen", data: ziplist(0xfe, 1, 0, 0, 0, 0x01, 'x'), want: []string{"x"}},
+		{
+			name: "integers",
+			data: ziplist(
+				0x00, 0xc0, 0x18, 0xfc, // int16 -1000
+				0x04, 0xd0, 0xa0, 0x86, 0x01, 0x00, // int32 100000
+				0x06, 0xe0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, // int64 max
+				0x09, 0xf0, 0xff, 0xff, 0xff, // int24 -1
+				0x04, 0xfe, 0x80, // int8 -128
+				0x03, 0xf1, // 0
+				0x01, 0xfd, // 12
+			),
+			want: []string{"-1000", "100000", "9223372036854775807", "-1", "-128", "0", "12"},
+		},
+		{name: "too short", data: []byte{0, 0, 0}, wantErr: true},
+		{name: "missing end", data: ziplist(0x00, 0x02, 'a', 'b')[:14], wantErr: true},
+		{name: "truncated prevlen", data: ziplist(0xfe, 1, 0)[:13], wantErr: true},
+		{name: "truncated string", data: ziplist(0x00, 0x05, 'a')[:13], wantErr: true},
+		{name: "truncated 14 bit length", data: ziplist(0x00, 0x40)[:12], wantErr: true},
+		{name: "32 bit length past end", data: ziplist(0x00, 0x80, 0xff, 0xff, 0xff, 0xfb, 'a'), wantErr: true},
+		{name: "truncated integer", data: ziplist(0x00, 0xe0, 0x01)[:13], wantErr: true},
+		{name: "invalid integer encoding", data: ziplist(0x00, 0xff), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeZiplist(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeZiplist() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeZiplist() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeZiplist() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// listpack 加上 6 个字节的头部和结尾的 0xFF
+func listpack(entries ...byte) []byte {
+	data := make([]byte, 6, 7+len(entries))
+	data = append(data, entries...)
+	return append(data, 0xff)
+}
+
+func TestDecodeListpack(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", data: listpack(), want: nil},
+		{name: "7 bit uint", data: listpack(0x05, 0x01), want: []string{"5"}},
+		{name: "6 bit string", data: listpack(0x82, 'h', 'i', 0x03), want: []string{"hi"}},
+		{name: "13 bit int", data: listpack(0xdf, 0xff, 0x02, 0xc1, 0x00, 0x02), want: []string{"-1", "256"}},
+		{name: "12 bit string", data: listpack(0xe0, 0x02, 'o', 'k', 0x04), want: []string{"ok"}},
+		{name: "32 bit string", data: listpack(0xf0, 0x01, 0, 0, 0, 'z', 0x06), want: []string{"z"}},
+		{
+			name: "wide integers",
+			data: listpack(
+				0xf1, 0xfe, 0xff, 0x03, // int16 -2
+				0xf2, 0x00, 0x00, 0x80, 0x04, // int24 min
+				0xf3, 0xa0, 0x86, 0x01, 0x00, 0x05, // int32 100000
+				0xf4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x09, // int64 min
+			),
+			want: []string{"-2", "-8388608", "100000", "-9223372036854775808"},
+		},
+		{
+			// 超过 127 字节的 entry，backlen 占 2 个字节
+			name: "two byte backlen",
+			data: listpack(append(append([]byte{0xe0, 200}, make([]byte, 200)...), 0x01, 0xca)...),
+			want: []string{string(make([]byte, 200))},
+		},
+		{name: "too short", data: []byte{0, 0, 0}, wantErr: true},
+		{name: "missing end", data: listpack(0x05, 0x01)[:8], wantErr: true},
+		{name: "truncated string", data: listpack(0x85, 'a')[:8], wantErr: true},
+		{name: "truncated 13 bit int", data: listpack(0xc1)[:7], wantErr: true},
+		{name: "truncated 12 bit length", data: listpack(0xe0)[:7], wantErr: true},
+		{name: "truncated 32 bit length", data: listpack(0xf0, 0x01)[:8], wantErr: true},
+		{name: "32 bit length past end", data: listpack(0xf0, 0xfb, 0xff, 0xff, 0xff, 'a'), wantErr: true},
+		{name: "truncated integer", data: listpack(0xf4, 0x01)[:8], wantErr: true},
+		{name: "invalid encoding", data: listpack(0xf5), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeListpack(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeListpack() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeListpack() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeListpack() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeIntset(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", data: []byte{2, 0, 0, 0, 0, 0, 0, 0}, want: []string{}},
+		{name: "int16", data: []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 0x07, 0x00}, want: []string{"-1", "7"}},
+		{name: "int32", data: []byte{4, 0, 0, 0, 1, 0, 0, 0, 0x00, 0x00, 0x00, 0x80}, want: []string{"-2147483648"}},
+		{
+			name: "int64",
+			data: []byte{8, 0, 0, 0, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+			want: []string{"9223372036854775807"},
+		},
+		{name: "too short", data: []byte{2, 0, 0, 0}, wantErr: true},
+		{name: "invalid width", data: []byte{3, 0, 0, 0, 0, 0, 0, 0}, wantErr: true},
+		{name: "truncated items", data: []byte{4, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0}, wantErr: true},
+		{name: "huge length", data: []byte{8, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0, 0, 0, 0, 0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeIntset(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeIntset() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeIntset() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeIntset() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeZipmap(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", data: []byte{0, 0xff}, want: nil},
+		{
+			name: "pairs",
+			data: []byte{2, 3, 'f', 'o', 'o', 3, 0, 'b', 'a', 'r', 1, 'k', 1, 0, 'v', 0xff},
+			want: []string{"foo", "bar", "k", "v"},
+		},
+		// free 表示值后面未使用的字节，需要跳过
+		{name: "free bytes", data: []byte{1, 1, 'k', 1, 2, 'v', 'x', 'x', 0xff}, want: []string{"k", "v"}},
+		{name: "4 byte length", data: []byte{1, 254, 1, 0, 0, 0, 'k', 0, 0, 0xff}, want: []string{"k", ""}},
+		{name: "too short", data: []byte{0}, wantErr: true},
+		{name: "missing end", data: []byte{1, 1, 'k', 1, 0, 'v'}, wantErr: true},
+		{name: "truncated key", data: []byte{1, 5, 'k'}, wantErr: true},
+		{name: "truncated value", data: []byte{1, 1, 'k', 5, 0, 'v'}, wantErr: true},
+		{name: "missing free", data: []byte{1, 1, 'k', 0}, wantErr: true},
+		{name: "truncated 4 byte length", data: []byte{1, 254, 1, 0}, wantErr: true},
+		{name: "invalid length", data: []byte{1, 1, 'k', 0xff, 0, 0xff}, wantErr: true},
+		{name: "free past end", data: []byte{1, 1, 'k', 1, 9, 'v', 0xff}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeZipmap(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeZipmap() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeZipmap() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeZipmap() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseRDBBytes 解析一段 RDB 数据，返回 key 到解析结果的映射
+func parseRDBBytes(t *testing.T, data []byte) map[string]rdbKey {
+	t.Helper()
+	keys := map[string]rdbKey{}
+	err := parseRDB(bufio.NewReader(bytes.NewReader(data)), true, func(key rdbKey) error {
+		if _, ok := keys[key.key]; ok {
+			t.Errorf("key %q parsed twice", key.key)
+		}
+		keys[key.key] = key
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestWriteRDBRoundTrip(t *testing.T) {
+	now := time.Now()
+	expiry := now.Add(time.Hour)
+	data := map[string]*Entry{
+		"k1":      {Type: TypeString, Value: []byte("v1")},
+		"empty":   {Type: TypeString, Value: []byte("")},
+		"number":  {Type: TypeString, Value: []byte("12345")},
+		"large":   {Type: TypeString, Value: bytes.Repeat([]byte("x"), 20000)},
+		"binary":  {Type: TypeString, Value: []byte{0, 0xff, '\r', '\n'}},
+		"ttl":     {Type: TypeString, Value: []byte("v"), ExpiryInMS: expiry},
+		"expired": {Type: TypeString, Value: []byte("v"), ExpiryInMS: now.Add(-time.Second)},
+		"h":       {Type: TypeHash, Value: testHash("f1", "a", "f2", "")},
+		"list":    {Type: TypeList, Value: []string{"a", "b", "a", ""}},
+		"set":     {Type: TypeSet, Value: map[string]struct{}{"a": {}, "1": {}}},
+		"zset":    {Type: TypeZSet, Value: map[string]float64{"a": 1.5, "b": -2, "c": math.Inf(1)}},
+	}
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, []map[string]*Entry{data}, now); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	if !bytes.HasPrefix(raw, []byte("REDIS0009")) {
+		t.Fatalf("RDB header = %q", raw[:9])
+	}
+	// 末尾 8 字节是除自身以外所有内容的 CRC64
+	body, checksum := raw[:len(raw)-8], raw[len(raw)-8:]
+	if got, want := binary.LittleEndian.Uint64(checksum), crc64Update(0, body); got != want {
+		t.Errorf("checksum = %x, want %x", got, want)
+	}
+
+	keys := parseRDBBytes(t, raw)
+	// 已过期的 key 不写入
+	if len(keys) != len(data)-1 {
+		t.Errorf("parsed %d keys, want %d", len(keys), len(data)-1)
+	}
+	if _, ok := keys["expired"]; ok {
+		t.Error("expired key was written")
+	}
+	for key, entry := range data {
+		got, ok := keys[key]
+		if !ok || entry.expired(now) {
+			continue
+		}
+		if !reflect.DeepEqual(plainValue(got.value), plainValue(entry.Value)) {
+			t.Errorf("key %q = %.40v, want %.40v", key, got.value, entry.Value)
+		}
+		if got.expiry.UnixMilli() != entry.ExpiryInMS.UnixMilli() {
+			t.Errorf("key %q expiry = %v, want %v", key, got.expiry, entry.ExpiryInMS)
+		}
+	}
+}
+
+func TestSaveReload(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, "dir", dir)
+	setConfig(t, "dbfilename", "dump.rdb")
+	t.Cleanup(resetStore)
+
+	resetStore()
+	call("SET", "k1", "v1")
+	call("SET", "k2", "v2")
+	call("SET", "ttl", "v", "EX", "100")
+	call("HSET", "h", "f", "v")
+	call("RPUSH", "list", "a", "b")
+	call("SADD", "set", "a")
+	call("ZADD", "zset", "1", "a")
+	if got := text(call("SAVE")); got != "OK" {
+		t.Fatalf("SAVE = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dump.rdb")); err != nil {
+		t.Fatal(err)
+	}
+	// 保存成功后不应留下临时文件
+	if matches, _ := filepath.Glob(filepath.Join(dir, "temp-*.rdb")); len(matches) != 0 {
+		t.Errorf("temp files left after SAVE: %v", matches)
+	}
+
+	resetStore()
+	if err := loadRdbFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if got := text(call("GET", key)); got != want {
+			t.Errorf("GET %s = %q, want %q", key, got, want)
+		}
+	}
+	if got := text(call("HGET", "h", "f")); got != "v" {
+		t.Errorf("HGET h f = %q, want %q", got, "v")
+	}
+	entry := lookupEntry("ttl")
+	if entry == nil || (entry.ExpiryInMS == time.Time{}) {
+		t.Error("key ttl lost its expiry across SAVE and reload")
+	}
+	for key, typ := range map[string]string{"list": TypeList, "set": TypeSet, "zset": TypeZSet} {
+		if entry := lookupEntry(key); entry == nil || entry.Type != typ {
+			t.Errorf("key %q after reload = %+v, want type %s", key, entry, typ)
+		}
+	}
+}
+
+func TestSaveReloadDatabases(t *testing.T) {
+	setConfig(t, "dir", t.TempDir())
+	setConfig(t, "dbfilename", "dump.rdb")
+	t.Cleanup(resetStore)
+
+	resetStore()
+	sc := &ServerConnection{}
+	callOn(sc, "SET", "k", "db0")
+	callOn(sc, "SELECT", "3")
+	callOn(sc, "SET", "k", "db3")
+	callOn(sc, "HSET", "h", "f", "v")
+	callOn(sc, "SELECT", "15")
+	callOn(sc, "RPUSH", "list", "a")
+	if got := text(call("SAVE")); got != "OK" {
+		t.Fatalf("SAVE = %q", got)
+	}
+
+	resetStore()
+	if err := loadRdbFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		db       int
+		key, typ string
+	}{
+		{0, "k", TypeString},
+		{3, "k", TypeString},
+		{3, "h", TypeHash},
+		{15, "list", TypeList},
+	} {
+		if entry := lookupEntryIn(tt.db, tt.key); entry == nil || entry.Type != tt.typ {
+			t.Errorf("db %d key %q after reload = %+v, want type %s", tt.db, tt.key, entry, tt.typ)
+		}
+	}
+	if got := lookupEntryIn(3, "k"); got != nil && string(got.Value.([]byte)) != "db3" {
+		t.Errorf("db 3 key k = %v, want db3", got.Value)
+	}
+	if lookupEntryIn(0, "h") != nil {
+		t.Error("hash h was loaded into db 0")
+	}
+}
+
+func TestCrc64(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+	}{
+		{data: "", want: 0},
+		// Redis crc64.c 中的测试向量
+		{data: "123456789", want: 0xe9c6d914c4b8d9ca},
+	}
+	for _, tt := range tests {
+		if got := crc64Update(0, []byte(tt.data)); got != tt.want {
+			t.Errorf("crc64Update(0, %q) = %#x, want %#x", tt.data, got, tt.want)
+		}
+	}
+
+	// 分段计算的结果和一次计算相同
+	if got := crc64Update(crc64Update(0, []byte("1234")), []byte("56789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("incremental crc64Update = %#x, want %#x", got, uint64(0xe9c6d914c4b8d9ca))
+	}
+}
+
+// testRDB 生成一份只包含 k -> value 的 RDB 文件
+func testRDB(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, []map[string]*Entry{{"k": {Type: TypeString, Value: []byte("value")}}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseRDBChecksum(t *testing.T) {
+	setConfig(t, "rdbchecksum", "yes")
+	data := testRDB(t)
+	parse := func(data []byte, verify bool) error {
+		return parseRDB(bufio.NewReader(bytes.NewReader(data)), verify, func(rdbKey) error { return nil })
+	}
+
+	if err := parse(data, true); err != nil {
+		t.Fatalf("valid file: %v", err)
+	}
+
+	// 修改值中的一个字节，长度和结构不变，只有校验和能发现
+	corrupt := append([]byte{}, data...)
+	corrupt[bytes.Index(corrupt, []byte("value"))] = 'V'
+	if err := parse(corrupt, true); err != errRdbChecksum {
+		t.Errorf("corrupt file with verify = %v, want %v", err, errRdbChecksum)
+	}
+	if err := parse(corrupt, false); err != nil {
+		t.Errorf("corrupt file without verify = %v, want nil", err)
+	}
+
+	// 截断的文件无论是否校验都是错误
+	for _, n := range []int{5, len(data) / 2, len(data) - 1} {
+		if err := parse(data[:n], false); err == nil {
+			t.Errorf("file truncated to %d bytes parsed without error", n)
+		}
+	}
+
+	// rdbchecksum no 写入的校验和为 0，加载时跳过校验
+	setConfig(t, "rdbchecksum", "no")
+	unchecked := testRDB(t)
+	if got := binary.LittleEndian.Uint64(unchecked[len(unchecked)-8:]); got != 0 {
+		t.Errorf("checksum with rdbchecksum no = %#x, want 0", got)
+	}
+	if err := parse(unchecked, true); err != nil {
+		t.Errorf("file without checksum: %v", err)
+	}
+
+	// 只接受 yes 和 no，非法的值不会改变配置
+	for _, value := range []string{"", "on", "YES"} {
+		if got := call("CONFIG", "SET", "rdbchecksum", value); got.typ != ERROR {
+			t.Errorf("CONFIG SET rdbchecksum %q = %+v, want an error", value, got)
+		}
+	}
+	if got := text(call("CONFIG", "GET", "rdbchecksum").array[1]); got != "no" {
+		t.Errorf("CONFIG GET rdbchecksum = %q, want %q", got, "no")
+	}
+}
+
+func TestLoadCorruptRDB(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, "dir", dir)
+	setConfig(t, "dbfilename", "dump.rdb")
+	setConfig(t, "rdbchecksum", "yes")
+	setConfig(t, "rdb-load-corrupt", RdbCorruptRename)
+	t.Cleanup(resetStore)
+
+	path := filepath.Join(dir, "dump.rdb")
+	data := testRDB(t)
+	data[bytes.Index(data, []byte("value"))] = 'V'
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// 校验失败时不加载任何数据
+	resetStore()
+	if err := loadRdbFileIntoKVMemoryStore(); err != errRdbChecksum {
+		t.Fatalf("loadRdbFileIntoKVMemoryStore() = %v, want %v", err, errRdbChecksum)
+	}
+	if got := call("GET", "k"); got.typ != NULL {
+		t.Errorf("GET k after a failed load = %+v, want NULL", got)
+	}
+
+	// rename 策略把文件移到一边，以空数据启动
+	loadRdbFile()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt RDB file is still in place: %v", err)
+	}
+	if matches, _ := filepath.Glob(path + ".corrupt-*"); len(matches) != 1 {
+		t.Errorf("corrupt files moved aside = %v, want one", matches)
+	}
+}
+
+func TestLoadRDBDBIndexOutOfRange(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, "dir", dir)
+	setConfig(t, "dbfilename", "dump.rdb")
+	t.Cleanup(resetStore)
+
+	resetStore()
+	sc := &ServerConnection{}
+	callOn(sc, "SELECT", "3")
+	callOn(sc, "SET", "k", "v")
+	if got := text(call("SAVE")); got != "OK" {
+		t.Fatalf("SAVE = %q", got)
+	}
+
+	// 文件没有损坏，只是 databases 配置得太小，错误要和损坏区分开
+	initDatabases(2)
+	err := loadRdbFileIntoKVMemoryStore()
+	var indexErr *rdbDBIndexError
+	if !errors.As(err, &indexErr) || indexErr.db != 3 {
+		t.Fatalf("loadRdbFileIntoKVMemoryStore() = %v, want a DB index error for db 3", err)
+	}
+
+	// 超出 int 范围的编号按文件损坏处理
+	data := append([]byte("REDIS0009"), opCodeSelectDB, 0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	err = parseRDB(bufio.NewReader(bytes.NewReader(data)), false, func(rdbKey) error { return nil })
+	if err == nil || errors.As(err, &indexErr) {
+		t.Errorf("parseRDB with a huge DB index = %v, want a corruption error", err)
+	}
+}
+
+func TestPersistenceInfo(t *testing.T) {
+	info := persistenceInfo()
+	for _, want := range []string{"rdb_bgsave_in_progress:0\r\n", "aof_enabled:0\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("persistenceInfo() = %q, want it to contain %q", info, want)
+		}
+	}
+
+	useAofDir(t)
+	if err := loadAofFileIntoKVMemoryStore(); err != nil {
+		t.Fatal(err)
+	}
+	if info := persistenceInfo(); !strings.Contains(info, "aof_enabled:1\r\n") {
+		t.Errorf("persistenceInfo() with AOF on = %q, want aof_enabled:1", info)
+	}
+}
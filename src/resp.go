@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"sync/atomic"
 )
 
 // 对应 RESP 的类型
@@ -14,6 +17,17 @@ const (
 	CommandInteger = ':'
 	CommandBulk    = '$'
 	CommandArray   = '*'
+
+	// RESP3 新增的类型
+	CommandNull      = '_'
+	CommandBoolean   = '#'
+	CommandDouble    = ','
+	CommandBigNumber = '('
+	CommandMap       = '%'
+	CommandSet       = '~'
+	CommandAttribute = '|'
+	CommandVerbatim  = '='
+	CommandPush      = '>'
 )
 
 // 支持的类型标识
@@ -24,20 +38,53 @@ const (
 	INTEGER = "INTEGER"
 	BULK    = "BULK"
 	ARRAY   = "ARRAY"
+
+	// NULLARRAY null 数组，RESP2 编码为 *-1，和 NULL（null 批量字符串 $-1）区分
+	NULLARRAY = "NULLARRAY"
+
+	// RESP3 类型，回复给 RESP2 客户端时会降级，见 MarshalProto
+	MAP       = "MAP"
+	SET       = "SET"
+	PUSH      = "PUSH"
+	ATTRIBUTE = "ATTRIBUTE"
+	DOUBLE    = "DOUBLE"
+	BOOLEAN   = "BOOLEAN"
+	BIGNUMBER = "BIGNUMBER"
+	VERBATIM  = "VERBATIM"
 )
 
 // Value redis 命令 set admin ahmed
 // Value resp 格式 *3\r\n$3\r\nset\r\n$5\r\nadmin\r\n$5\r\nahmed
 type Value struct {
-	typ   string
-	str   string  // 保存从简单字符串接收到的字符串值
-	num   int     // 保存接收到到整数值
-	bulk  string  // 保存从批量字符串接收到的字符串值
-	array []Value // 保存从数组接收到的所有值
+	typ     string
+	str     string  // 保存从简单字符串接收到的字符串值，big number 的数字，verbatim string 的格式
+	num     int     // 保存接收到到整数值
+	bulk    []byte  // 保存从批量字符串接收到的内容，可以包含任意字节，verbatim string 的内容
+	array   []Value // 保存从数组接收到的所有值，map 和 attribute 按键、值交替保存
+	double  float64 // double 的值
+	boolean bool    // boolean 的值
+}
+
+// 请求大小的限制，防止恶意的 *999999999 这类请求耗尽内存
+const (
+	maxMultibulkLen = 1024 * 1024 // 数组最多包含的元素个数
+	maxLineLen      = 64 * 1024   // 长度行（*N、$N）的最大长度
+)
+
+// protoMaxBulkLen 批量字符串的最大长度，对应 proto-max-bulk-len 配置
+var protoMaxBulkLen atomic.Int64
+
+// ProtocolError 客户端发送的数据不符合 RESP 协议，回复错误后需要关闭连接
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
 }
 
 type Writer struct {
-	writer io.Writer
+	writer *bufio.Writer
 }
 
 type Resp struct {
@@ -49,6 +96,11 @@ func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
+// Buffered 已经从连接读进缓冲区、还没有解析的字节数，大于 0 说明流水线中还有命令
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
 // 在这个函数中，我们每次读取一个字节，直到到达 '\r'，表示行尾。然后，我们返回没有最后 2 个字节（即 '\r\n'）的行数以及行中的字节数。
 func (r *Resp) readLine() (line []byte, n int, err error) {
 	for {
@@ -61,6 +113,12 @@ func (r *Resp) readLine() (line []byte, n int, err error) {
 		if len(line) >= 2 && line[len(line)-2] == '\r' {
 			break
 		}
+		if len(line) > maxLineLen {
+			return nil, 0, &ProtocolError{msg: "too big count string"}
+		}
+	}
+	if line[len(line)-1] != '\n' {
+		return nil, 0, &ProtocolError{msg: "expected '\\n' after '\\r'"}
 	}
 	return line[:len(line)-2], n, nil
 }
@@ -97,25 +155,228 @@ func (r *Resp) Read() (Value, error) {
 		return r.readArray()
 	case CommandBulk:
 		return r.readBulk()
+	case CommandString:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: STRING, str: string(line)}, nil
+	case CommandError:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: ERROR, str: string(line)}, nil
+	case CommandInteger:
+		num, _, err := r.readInteger()
+		if _, ok := err.(*strconv.NumError); ok {
+			return Value{}, &ProtocolError{msg: "invalid integer"}
+		}
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: INTEGER, num: num}, nil
 	default:
-		fmt.Printf("Unknown type: %v", string(_type))
-		return Value{}, nil
+		return Value{}, &ProtocolError{msg: fmt.Sprintf("unknown type '%c'", _type)}
+	}
+}
+
+// ReadCommand 读取客户端发来的一条命令。以 * 开头的是 RESP 数组，
+// 否则是 telnet/nc 使用的内联命令：一行以空格分隔的参数，解析成和 RESP 数组相同的 Value
+func (r *Resp) ReadCommand() (Value, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return Value{}, err
+	}
+	if first[0] != CommandArray {
+		return r.readInline()
+	}
+	_, _ = r.reader.ReadByte()
+	return r.readMultibulk()
+}
+
+// readMultibulk 读取一条 RESP 格式的命令，数组的元素只能是批量字符串。
+// 和 Redis 一样，*-1 和 *0 都当作空命令
+func (r *Resp) readMultibulk() (Value, error) {
+	arrayLen, err := r.readArrayLen()
+	if err != nil {
+		return Value{}, err
+	}
+
+	v := Value{typ: ARRAY, array: make([]Value, 0, preallocSize(uint64(arrayLen)))}
+	for i := 0; i < arrayLen; i++ {
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return Value{}, err
+		}
+		if _type != CommandBulk {
+			return Value{}, &ProtocolError{msg: fmt.Sprintf("expected '$', got '%c'", _type)}
+		}
+		val, err := r.readBulk()
+		if err != nil {
+			return Value{}, err
+		}
+		if val.typ == NULL {
+			return Value{}, &ProtocolError{msg: "invalid bulk length"}
+		}
+		v.array = append(v.array, val)
+	}
+	return v, nil
+}
+
+// readInline 读取一行内联命令，行尾的 \r 可以省略。空行返回空数组
+func (r *Resp) readInline() (Value, error) {
+	var line []byte
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return Value{}, err
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+		if len(line) > maxLineLen {
+			return Value{}, &ProtocolError{msg: "too big inline request"}
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+
+	args, ok := splitArgs(string(line))
+	if !ok {
+		return Value{}, &ProtocolError{msg: "unbalanced quotes in request"}
+	}
+	v := Value{typ: ARRAY, array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		v.array = append(v.array, Value{typ: BULK, bulk: []byte(arg)})
+	}
+	return v, nil
+}
+
+// splitArgs 按 Redis 的规则拆分内联命令的参数：参数之间以空白分隔，
+// 双引号中支持 \n \r \t \b \a \xHH 等转义，单引号中只支持 \'，
+// 引号结束后必须紧跟空白或者行尾。引号不匹配时返回 false
+func splitArgs(line string) ([]string, bool) {
+	args := []string{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, true
+		}
+
+		var arg []byte
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			switch {
+			case inDouble:
+				if i == len(line) {
+					return nil, false
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(n))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescapeByte(line[i]))
+				case c == '"':
+					// 结束的引号后面必须是空白或者行尾
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if i == len(line) {
+					return nil, false
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+				switch c := line[i]; {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// unescapeByte 双引号中 \ 后面的字符，不认识的转义保留字符本身
+func unescapeByte(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
 	}
 }
 
 // 解析一个数组
+// 元素可以是任意类型，包括嵌套的数组，*-1 解析为 NULLARRAY
 func (r *Resp) readArray() (Value, error) {
 	v := Value{}
-	v.typ = "array"
+	v.typ = ARRAY
 
 	// read length of array
-	arrayLen, _, err := r.readInteger()
+	arrayLen, err := r.readArrayLen()
 	if err != nil {
 		return v, err
 	}
+	if arrayLen < 0 {
+		return Value{typ: NULLARRAY}, nil
+	}
 
 	// foreach line, parse and read the value
-	v.array = make([]Value, 0)
+	v.array = make([]Value, 0, preallocSize(uint64(arrayLen)))
 	for i := 0; i < arrayLen; i++ {
 		val, err := r.Read()
 		if err != nil {
@@ -129,27 +390,44 @@ func (r *Resp) readArray() (Value, error) {
 	return v, nil
 }
 
+// readArrayLen 读取数组的长度，-1 表示 null 数组
+func (r *Resp) readArrayLen() (int, error) {
+	arrayLen, _, err := r.readInteger()
+	if _, ok := err.(*strconv.NumError); ok || (err == nil && (arrayLen < -1 || arrayLen > maxMultibulkLen)) {
+		return 0, &ProtocolError{msg: "invalid multibulk length"}
+	}
+	return arrayLen, err
+}
+
+// readBulk 读取一个批量字符串，内容可以包含任意字节，$-1 解析为 NULL
 func (r *Resp) readBulk() (Value, error) {
 	v := Value{}
-	v.typ = "bulk"
+	v.typ = BULK
 
 	bulkLen, _, err := r.readInteger()
+	if _, ok := err.(*strconv.NumError); ok || (err == nil && (bulkLen < -1 || int64(bulkLen) > protoMaxBulkLen.Load())) {
+		return v, &ProtocolError{msg: "invalid bulk length"}
+	}
 	if err != nil {
 		return v, err
 	}
-
-	bulk := make([]byte, bulkLen)
-	_, err = r.reader.Read(bulk)
-	if err != nil {
-		return Value{}, err
+	if bulkLen < 0 {
+		return Value{typ: NULL}, nil
 	}
-	v.bulk = string(bulk)
 
-	// Read the trailing CRLF
-	_, _, err = r.readLine()
-	if err != nil {
+	// 内容和结尾的 CRLF 一起读取，ReadFull 保证读满，不会因为一次 Read 返回的数据不够而截断
+	bulk := make([]byte, bulkLen+2)
+	if _, err = io.ReadFull(r.reader, bulk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return Value{}, err
 	}
+	if bulk[bulkLen] != '\r' || bulk[bulkLen+1] != '\n' {
+		return Value{}, &ProtocolError{msg: "expected CRLF after bulk string"}
+	}
+	// 读到的内容直接保存到数据库中，不再复制；限制容量，对它 append 时不会覆盖后面的 CRLF
+	v.bulk = bulk[:bulkLen:bulkLen]
 
 	return v, nil
 }
@@ -157,11 +435,12 @@ func (r *Resp) readBulk() (Value, error) {
 // -------------------------- 把 Value 结构体转化为 RESP -------------------------
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	return &Writer{writer: bufio.NewWriter(w)}
 }
 
-func (w *Writer) Write(v Value) error {
-	var bytes = v.Marshal()
+// Write 按连接协商的协议版本（2 或 3）编码 v 并写入缓冲区
+func (w *Writer) Write(v Value, proto int) error {
+	var bytes = v.MarshalProto(proto)
 
 	logger.Debug("服务端返回的数据：")
 	logger.Debug(string(bytes))
@@ -174,10 +453,23 @@ func (w *Writer) Write(v Value) error {
 	return nil
 }
 
+// Flush 把缓冲区中的回复发送给客户端
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
+
+// Marshal 按 RESP2 编码，AOF 和 RESP2 客户端使用
 func (v Value) Marshal() []byte {
+	return v.MarshalProto(2)
+}
+
+// MarshalProto 按协议版本编码。RESP2 客户端不认识 RESP3 的类型，按 Redis 的方式降级：
+// map 展开成键值交替的数组，set/push 变成数组，double、big number 和 verbatim string 变成批量字符串，
+// boolean 变成整数 1/0，attribute 直接省略
+func (v Value) MarshalProto(proto int) []byte {
 	switch v.typ {
 	case ARRAY:
-		return v.marshalArray()
+		return v.marshalAggregate(CommandArray, len(v.array), proto)
 	case BULK:
 		return v.marshalBulk()
 	case STRING:
@@ -185,22 +477,68 @@ func (v Value) Marshal() []byte {
 	case INTEGER:
 		return v.marshalInteger()
 	case NULL:
-		return v.marshallNull()
+		return v.marshallNull(proto)
+	case NULLARRAY:
+		return v.marshallNullArray(proto)
 	case ERROR:
 		return v.marshallError()
+	case MAP:
+		if proto < 3 {
+			return v.marshalAggregate(CommandArray, len(v.array), proto)
+		}
+		return v.marshalAggregate(CommandMap, len(v.array)/2, proto)
+	case SET:
+		if proto < 3 {
+			return v.marshalAggregate(CommandArray, len(v.array), proto)
+		}
+		return v.marshalAggregate(CommandSet, len(v.array), proto)
+	case PUSH:
+		if proto < 3 {
+			return v.marshalAggregate(CommandArray, len(v.array), proto)
+		}
+		return v.marshalAggregate(CommandPush, len(v.array), proto)
+	case ATTRIBUTE:
+		if proto < 3 {
+			return []byte{}
+		}
+		return v.marshalAggregate(CommandAttribute, len(v.array)/2, proto)
+	case DOUBLE:
+		if proto < 3 {
+			return Value{typ: BULK, bulk: []byte(formatDouble(v.double))}.marshalBulk()
+		}
+		return marshalLine(CommandDouble, formatDouble(v.double))
+	case BOOLEAN:
+		if proto < 3 {
+			return Value{typ: INTEGER, num: boolToInt(v.boolean)}.marshalInteger()
+		}
+		if v.boolean {
+			return marshalLine(CommandBoolean, "t")
+		}
+		return marshalLine(CommandBoolean, "f")
+	case BIGNUMBER:
+		if proto < 3 {
+			return Value{typ: BULK, bulk: []byte(v.str)}.marshalBulk()
+		}
+		return marshalLine(CommandBigNumber, v.str)
+	case VERBATIM:
+		if proto < 3 {
+			return Value{typ: BULK, bulk: v.bulk}.marshalBulk()
+		}
+		return v.marshalVerbatim()
 	default:
 		return []byte{}
 	}
 }
 
-func (v Value) marshalArray() []byte {
+// marshalAggregate 编码数组、map、set 等聚合类型，count 是头部的元素个数（map 和 attribute 是键值对的个数）
+func (v Value) marshalAggregate(prefix byte, count int, proto int) []byte {
 	var bytes []byte
-	bytes = append(bytes, CommandArray)
-	bytes = append(bytes, strconv.Itoa(len(v.array))...)
+	bytes = append(bytes, prefix)
+	bytes = append(bytes, strconv.Itoa(count)...)
 	bytes = append(bytes, '\r', '\n')
 
 	for i := 0; i < len(v.array); i++ {
-		bytes = append(bytes, v.array[i].Marshal()...)
+		bytes = append(bytes, v.array[i].MarshalProto(proto)...)
 	}
 	return bytes
 }
@@ -217,31 +555,75 @@ func (v Value) marshalBulk() []byte {
 }
 
 func (v Value) marshalString() []byte {
+	return marshalLine(CommandString, v.str)
+}
+func (v Value) marshalInteger() []byte {
+	return marshalLine(CommandInteger, strconv.Itoa(v.num))
+}
+
+// marshallNull RESP3 有专门的 null 类型，RESP2 使用空的批量字符串
+func (v Value) marshallNull(proto int) []byte {
+	if proto >= 3 {
+		return marshalLine(CommandNull, "")
+	}
+	return []byte("$-1\r\n")
+}
+
+func (v Value) marshallNullArray(proto int) []byte {
+	if proto >= 3 {
+		return marshalLine(CommandNull, "")
+	}
+	return []byte("*-1\r\n")
+}
+
+func (v Value) marshallError() []byte {
+	return marshalLine(CommandError, v.str)
+}
+
+// marshalVerbatim 编码 verbatim string：=长度\r\n格式:内容\r\n，格式为 3 个字符，没有指定时使用 txt
+func (v Value) marshalVerbatim() []byte {
+	format := v.str
+	if format == "" {
+		format = "txt"
+	}
+	content := format + ":" + string(v.bulk)
 	var bytes []byte
-	bytes = append(bytes, CommandString)
-	bytes = append(bytes, v.str...)
+	bytes = append(bytes, CommandVerbatim)
+	bytes = append(bytes, strconv.Itoa(len(content))...)
+	bytes = append(bytes, '\r', '\n')
+	bytes = append(bytes, content...)
 	bytes = append(bytes, '\r', '\n')
 
 	return bytes
 }
-func (v Value) marshalInteger() []byte {
+
+// marshalLine 编码只有一行的类型：类型标识 + 内容 + \r\n
+func marshalLine(prefix byte, line string) []byte {
 	var bytes []byte
-	bytes = append(bytes, CommandInteger)
-	bytes = append(bytes, v.str...)
+	bytes = append(bytes, prefix)
+	bytes = append(bytes, line...)
 	bytes = append(bytes, '\r', '\n')
 
 	return bytes
 }
 
-func (v Value) marshallNull() []byte {
-	return []byte("$-1\r\n")
+// formatDouble 和 Redis 一样输出 inf、-inf、nan，其余按最短的精确表示输出
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
 }
 
-func (v Value) marshallError() []byte {
-	var bytes []byte
-	bytes = append(bytes, CommandError)
-	bytes = append(bytes, v.str...)
-	bytes = append(bytes, '\r', '\n')
-
-	return bytes
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		ok   bool
+	}{
+		{line: "", want: []string{}, ok: true},
+		{line: "  \t ", want: []string{}, ok: true},
+		{line: "set a b", want: []string{"set", "a", "b"}, ok: true},
+		{line: "  set   a\tb  ", want: []string{"set", "a", "b"}, ok: true},
+		{line: `set "hello world"`, want: []string{"set", "hello world"}, ok: true},
+		{line: `""`, want: []string{""}, ok: true},
+		{line: `"a\x41\n\r\t\b\a"`, want: []string{"aA\n\r\t\b\a"}, ok: true},
+		{line: `"\x4"`, want: []string{"x4"}, ok: true},
+		{line: `"\xzz"`, want: []string{"xzz"}, ok: true},
+		{line: `"\"q\"\\"`, want: []string{`"q"\`}, ok: true},
+		{line: `'it\'s'`, want: []string{"it's"}, ok: true},
+		{line: `'a\nb'`, want: []string{`a\nb`}, ok: true},
+		{line: `a"b c"`, want: []string{"ab c"}, ok: true},
+		{line: `"unterminated`, ok: false},
+		{line: `'unterminated`, ok: false},
+		{line: `"ends\"`, ok: false},
+		{line: `"a"b`, ok: false},
+		{line: `'a'b`, ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := splitArgs(tt.line)
+		if ok != tt.ok {
+			t.Errorf("splitArgs(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalProto(t *testing.T) {
+	tests := []struct {
+		name  string
+		value Value
+		resp2 string
+		resp3 string
+	}{
+		{"string", Value{typ: STRING, str: "OK"}, "+OK\r\n", "+OK\r\n"},
+		{"error", Value{typ: ERROR, str: "ERR bad"}, "-ERR bad\r\n", "-ERR bad\r\n"},
+		{"bulk", Value{typ: BULK, bulk: []byte("hi")}, "$2\r\nhi\r\n", "$2\r\nhi\r\n"},
+		{"integer", Value{typ: INTEGER, num: -42}, ":-42\r\n", ":-42\r\n"},
+		{"null", Value{typ: NULL}, "$-1\r\n", "_\r\n"},
+		{"null array", Value{typ: NULLARRAY}, "*-1\r\n", "_\r\n"},
+		{"boolean", Value{typ: BOOLEAN, boolean: true}, ":1\r\n", "#t\r\n"},
+		{"double", Value{typ: DOUBLE, double: 1.5}, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"inf", Value{typ: DOUBLE, double: math.Inf(-1)}, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"big number", Value{typ: BIGNUMBER, str: "12345678901234567890"}, "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{"verbatim", Value{typ: VERBATIM, bulk: []byte("text")}, "$4\r\ntext\r\n", "=8\r\ntxt:text\r\n"},
+		{
+			"map",
+			Value{typ: MAP, array: []Value{{typ: BULK, bulk: []byte("k")}, {typ: NULL}}},
+			"*2\r\n$1\r\nk\r\n$-1\r\n",
+			"%1\r\n$1\r\nk\r\n_\r\n",
+		},
+		{
+			"set",
+			Value{typ: SET, array: []Value{{typ: BULK, bulk: []byte("a")}}},
+			"*1\r\n$1\r\na\r\n",
+			"~1\r\n$1\r\na\r\n",
+		},
+		{
+			"push",
+			Value{typ: PUSH, array: []Value{{typ: BULK, bulk: []byte("message")}}},
+			"*1\r\n$7\r\nmessage\r\n",
+			">1\r\n$7\r\nmessage\r\n",
+		},
+		{
+			// RESP2 没有 attribute，直接省略
+			"attribute",
+			Value{typ: ATTRIBUTE, array: []Value{{typ: BULK, bulk: []byte("k")}, {typ: BULK, bulk: []byte("v")}}},
+			"",
+			"|1\r\n$1\r\nk\r\n$1\r\nv\r\n",
+		},
+		{
+			// 嵌套的聚合类型也要按协议版本降级
+			"nested",
+			Value{typ: ARRAY, array: []Value{{typ: MAP, array: []Value{{typ: BULK, bulk: []byte("d")}, {typ: DOUBLE, double: 2}}}}},
+			"*1\r\n*2\r\n$1\r\nd\r\n$1\r\n2\r\n",
+			"*1\r\n%1\r\n$1\r\nd\r\n,2\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(tt.value.MarshalProto(2)); got != tt.resp2 {
+				t.Errorf("RESP2 = %q, want %q", got, tt.resp2)
+			}
+			if got := string(tt.value.MarshalProto(3)); got != tt.resp3 {
+				t.Errorf("RESP3 = %q, want %q", got, tt.resp3)
+			}
+		})
+	}
+}
+
+func TestReadRESP2(t *testing.T) {
+	tests := []struct {
+		name  string
+		value Value
+	}{
+		{"string", Value{typ: STRING, str: "OK"}},
+		{"error", Value{typ: ERROR, str: "ERR something went wrong"}},
+		{"integer", Value{typ: INTEGER, num: 1234}},
+		{"negative integer", Value{typ: INTEGER, num: -1}},
+		{"bulk", Value{typ: BULK, bulk: []byte("hello")}},
+		{"empty bulk", Value{typ: BULK, bulk: []byte("")}},
+		{"binary bulk", Value{typ: BULK, bulk: []byte("a\r\nb\x00")}},
+		{"null", Value{typ: NULL}},
+		{"null array", Value{typ: NULLARRAY}},
+		{"empty array", Value{typ: ARRAY, array: []Value{}}},
+		{
+			"nested",
+			Value{typ: ARRAY, array: []Value{
+				{typ: INTEGER, num: 1},
+				{typ: ARRAY, array: []Value{
+					{typ: BULK, bulk: []byte("a")},
+					{typ: NULL},
+					{typ: ARRAY, array: []Value{{typ: STRING, str: "deep"}}},
+				}},
+				{typ: NULLARRAY},
+				{typ: ERROR, str: "ERR inner"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.value.Marshal()
+			got, err := NewResp(bytes.NewReader(data)).Read()
+			if err != nil {
+				t.Fatalf("Read(%q) error: %v", data, err)
+			}
+			if !reflect.DeepEqual(got, tt.value) {
+				t.Errorf("Read(%q) = %+v, want %+v", data, got, tt.value)
+			}
+			if again := got.Marshal(); !bytes.Equal(again, data) {
+				t.Errorf("Marshal after Read = %q, want %q", again, data)
+			}
+		})
+	}
+}
+
+func TestReadRESP2Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unknown type", "?x\r\n", "Protocol error: unknown type '?'"},
+		{"invalid integer", ":abc\r\n", "Protocol error: invalid integer"},
+		{"invalid array length", "*-2\r\n", "Protocol error: invalid multibulk length"},
+		{"invalid bulk length", "$-2\r\n", "Protocol error: invalid bulk length"},
+		{"missing CRLF", "$2\r\nabc\r\n", "Protocol error: expected CRLF after bulk string"},
+		{"truncated bulk", "$5\r\nab", io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewResp(strings.NewReader(tt.data)).Read()
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Read(%q) error = %v, want %q", tt.data, err, tt.want)
+			}
+		})
+	}
+}
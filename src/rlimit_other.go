@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// openFileLimit 没有 RLIMIT_NOFILE 的平台不限制 maxclients
+func openFileLimit() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanSeed 计算 key 哈希值的种子，进程内固定，游标在重启之后失效
+var scanSeed = maphash.MakeSeed()
+
+func keyHash(key string) uint64 {
+	return maphash.String(scanSeed, key)
+}
+
+// scanTableMinSize 桶数量的下限，必须是 2 的幂
+const scanTableMinSize = 4
+
+// scanTable 键空间的遍历索引，按哈希值把 key 分到 2^n 个桶里，key 比桶多时桶的数量翻倍，
+// 不到桶数量的 1/8 时减半。SCAN 的游标是桶的编号，按 Redis dictScan 的反向二进制顺序递增，
+// 所以即使两次 SCAN 之间桶的数量发生了变化，遍历期间一直存在的 key 也至少会被返回一次。
+// 零值可以直接使用，由 STORAGE 的 set/remove 维护
+type scanTable struct {
+	buckets [][]string
+	count   int
+}
+
+// add 加入一个新的 key，调用方保证 key 不在表中
+func (t *scanTable) add(key string) {
+	if len(t.buckets) == 0 {
+		t.buckets = make([][]string, scanTableMinSize)
+	}
+	t.count++
+	if t.count > len(t.buckets) {
+		t.resize(len(t.buckets) * 2)
+	}
+	i := keyHash(key) & uint64(len(t.buckets)-1)
+	t.buckets[i] = append(t.buckets[i], key)
+}
+
+// remove 删除一个表中的 key
+func (t *scanTable) remove(key string) {
+	i := keyHash(key) & uint64(len(t.buckets)-1)
+	bucket := t.buckets[i]
+	for j := range bucket {
+		if bucket[j] == key {
+			last := len(bucket) - 1
+			bucket[j], bucket[last] = bucket[last], ""
+			t.buckets[i] = bucket[:last]
+			break
+		}
+	}
+	t.count--
+	if len(t.buckets) > scanTableMinSize && t.count*8 < len(t.buckets) {
+		t.resize(len(t.buckets) / 2)
+	}
+}
+
+// resize 把所有 key 重新分配到 size 个桶里
+func (t *scanTable) resize(size int) {
+	buckets := make([][]string, size)
+	mask := uint64(size - 1)
+	for _, bucket := range t.buckets {
+		for _, key := range bucket {
+			i := keyHash(key) & mask
+			buckets[i] = append(buckets[i], key)
+		}
+	}
+	t.buckets = buckets
+}
+
+// clone 复制一份索引
+func (t *scanTable) clone() scanTable {
+	buckets := make([][]string, len(t.buckets))
+	for i, bucket := range t.buckets {
+		buckets[i] = append([]string(nil), bucket...)
+	}
+	return scanTable{buckets: buckets, count: t.count}
+}
+
+// scan 访问游标对应的桶中的所有 key，返回下一个游标，返回 0 表示遍历结束。
+// 游标的高位在表变大时用来区分新拆分出来的桶，所以递增时先把二进制位反转
+func (t *scanTable) scan(cursor uint64, visit func(key string)) uint64 {
+	if len(t.buckets) == 0 {
+		return 0
+	}
+	mask := uint64(len(t.buckets) - 1)
+	for _, key := range t.buckets[cursor&mask] {
+		visit(key)
+	}
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// scanOptions SCAN 系列命令的 MATCH/COUNT/TYPE 参数
+type scanOptions struct {
+	match   string // 为空时不过滤
+	count   int
+	keyType string // 为空时不过滤，只有 SCAN 支持
+}
+
+// parseScanOptions 解析游标之后的参数，allowType 表示是否接受 TYPE
+func parseScanOptions(args []Value, allowType bool) (scanOptions, *Value) {
+	opts := scanOptions{count: 10}
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i].bulk))
+		if i+1 >= len(args) {
+			return opts, &Value{typ: ERROR, str: "ERR syntax error"}
+		}
+		switch {
+		case option == "MATCH":
+			opts.match = string(args[i+1].bulk)
+		case option == "COUNT":
+			count, err := strconv.Atoi(string(args[i+1].bulk))
+			if err != nil {
+				return opts, &Value{typ: ERROR, str: "ERR value is not an integer or out of range"}
+			}
+			if count < 1 {
+				return opts, &Value{typ: ERROR, str: "ERR syntax error"}
+			}
+			opts.count = count
+		case option == "TYPE" && allowType:
+			opts.keyType = strings.ToLower(string(args[i+1].bulk))
+		default:
+			return opts, &Value{typ: ERROR, str: "ERR syntax error"}
+		}
+		i++
+	}
+	return opts, nil
+}
+
+// parseCursor 游标是无符号的 64 位整数
+func parseCursor(arg string) (uint64, *Value) {
+	cursor, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, &Value{typ: ERROR, str: "ERR invalid cursor"}
+	}
+	return cursor, nil
+}
+
+// scanReply SCAN 系列命令的回复：下一个游标和这一批元素
+func scanReply(cursor uint64, items []Value) Value {
+	return Value{typ: ARRAY, array: []Value{
+		{typ: BULK, bulk: []byte(strconv.FormatUint(cursor, 10))},
+		{typ: ARRAY, array: items},
+	}}
+}
+
+// scanIndex 从 cursor 开始访问索引中的桶，凑够 count 个元素就返回下一个游标和取出的元素。
+// 和 Redis 一样最多访问 count*10 个桶，避免在稀疏的表上一次访问太多空桶
+func scanIndex(t *scanTable, cursor uint64, count int) (uint64, []string) {
+	var names []string
+	for visits := count * 10; ; {
+		cursor = t.scan(cursor, func(name string) {
+			names = append(names, name)
+		})
+		visits--
+		if cursor == 0 || visits == 0 || len(names) >= count {
+			return cursor, names
+		}
+	}
+}
+
+// scan SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]。
+// 每次访问若干个桶，凑够 COUNT 个 key 就返回，MATCH 和 TYPE 在取出之后再过滤，
+// 所以一次返回的 key 可能少于 COUNT，甚至为空，只有返回的游标为 0 才表示遍历结束
+func scan(sc *ServerConnection, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'scan' command"}
+	}
+	cursor, errValue := parseCursor(string(args[0].bulk))
+	if errValue != nil {
+		return *errValue
+	}
+	opts, errValue := parseScanOptions(args[1:], true)
+	if errValue != nil {
+		return *errValue
+	}
+
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	cursor, names := scanIndex(&db.Keys, cursor, opts.count)
+
+	now := time.Now()
+	items := []Value{}
+	for _, name := range names {
+		entry := db.Data[name]
+		if entry.expired(now) {
+			continue
+		}
+		if opts.match != "" && !globMatch(opts.match, name) {
+			continue
+		}
+		if opts.keyType != "" && entry.Type != opts.keyType {
+			continue
+		}
+		items = append(items, Value{typ: BULK, bulk: []byte(name)})
+	}
+	return scanReply(cursor, items)
+}
+
+// hScan HSCAN key cursor [MATCH pattern] [COUNT count]，回复中字段和值交替排列。
+// 使用 hash 自己的遍历索引，遍历方式和保证都和 SCAN 相同
+func hScan(sc *ServerConnection, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'hscan' command"}
+	}
+	cursor, errValue := parseCursor(string(args[1].bulk))
+	if errValue != nil {
+		return *errValue
+	}
+	opts, errValue := parseScanOptions(args[2:], false)
+	if errValue != nil {
+		return *errValue
+	}
+
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	hash, errValue := db.lookupHash(string(args[0].bulk))
+	if errValue != nil {
+		return *errValue
+	}
+
+	cursor, names := scanIndex(&hash.Index, cursor, opts.count)
+	items := []Value{}
+	for _, name := range names {
+		if opts.match != "" && !globMatch(opts.match, name) {
+			continue
+		}
+		items = append(items, Value{typ: BULK, bulk: []byte(name)}, Value{typ: BULK, bulk: hash.Fields[name]})
+	}
+	return scanReply(cursor, items)
+}
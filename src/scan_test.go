@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// scanAll 从游标 0 开始完整遍历 t，每访问一个桶之后调用一次 step，返回访问到的 key 和出现的次数
+func scanAll(t *scanTable, step func(calls int)) map[string]int {
+	seen := map[string]int{}
+	cursor, calls := uint64(0), 0
+	for {
+		cursor = t.scan(cursor, func(key string) {
+			seen[key]++
+		})
+		calls++
+		if cursor == 0 {
+			return seen
+		}
+		step(calls)
+	}
+}
+
+func TestScanTableFullIteration(t *testing.T) {
+	var table scanTable
+	for i := 0; i < 1000; i++ {
+		table.add(strconv.Itoa(i))
+	}
+	seen := scanAll(&table, func(int) {})
+	if len(seen) != 1000 {
+		t.Fatalf("scan returned %d keys, want 1000", len(seen))
+	}
+	// 表不变时每个 key 只返回一次
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("key %q returned %d times", key, n)
+		}
+	}
+}
+
+func TestScanTableEmpty(t *testing.T) {
+	var table scanTable
+	if cursor := table.scan(0, func(key string) { t.Errorf("unexpected key %q", key) }); cursor != 0 {
+		t.Errorf("scan on empty table = %d, want 0", cursor)
+	}
+}
+
+// addKeys 和 removeKeys 加入、删除 prefix0 到 prefix(n-1)
+func addKeys(table *scanTable, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		table.add(prefix + strconv.Itoa(i))
+	}
+}
+
+func removeKeys(table *scanTable, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		table.remove(prefix + strconv.Itoa(i))
+	}
+}
+
+// 遍历期间表变大或变小，一直存在的 key 至少返回一次
+func TestScanTableResize(t *testing.T) {
+	tests := []struct {
+		name string
+		step func(table *scanTable, calls int)
+	}{
+		{
+			name: "grow",
+			step: func(table *scanTable, calls int) {
+				switch calls {
+				case 3:
+					addKeys(table, "a", 20000)
+				case 50:
+					addKeys(table, "b", 50000)
+				}
+			},
+		},
+		{
+			name: "shrink",
+			step: func(table *scanTable, calls int) {
+				if calls == 3 {
+					removeKeys(table, "tmp", 5000)
+				}
+			},
+		},
+		{
+			name: "grow and shrink",
+			step: func(table *scanTable, calls int) {
+				switch calls {
+				case 5:
+					addKeys(table, "a", 20000)
+				case 40:
+					removeKeys(table, "a", 20000)
+					removeKeys(table, "tmp", 5000)
+				case 60:
+					addKeys(table, "b", 30000)
+				case 300:
+					removeKeys(table, "b", 30000)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var table scanTable
+			addKeys(&table, "", 500)
+			addKeys(&table, "tmp", 5000)
+			sizes := map[int]bool{len(table.buckets): true}
+			seen := scanAll(&table, func(calls int) {
+				tt.step(&table, calls)
+				sizes[len(table.buckets)] = true
+			})
+			if len(sizes) < 2 {
+				t.Fatalf("table never resized during scan")
+			}
+			for i := 0; i < 500; i++ {
+				if seen[strconv.Itoa(i)] == 0 {
+					t.Errorf("key %d missing from scan", i)
+				}
+			}
+		})
+	}
+}
+
+func TestScanTableClone(t *testing.T) {
+	var table scanTable
+	for i := 0; i < 100; i++ {
+		table.add(strconv.Itoa(i))
+	}
+	copied := table.clone()
+	for i := 0; i < 100; i++ {
+		table.remove(strconv.Itoa(i))
+	}
+	if seen := scanAll(&copied, func(int) {}); len(seen) != 100 {
+		t.Errorf("clone returned %d keys after the original was emptied, want 100", len(seen))
+	}
+}
+
+// scanCommand 用 SCAN 或 HSCAN 遍历到游标为 0，返回每个元素出现的次数
+func scanCommand(t *testing.T, args ...string) map[string]int {
+	t.Helper()
+	seen := map[string]int{}
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 1000 {
+			t.Fatalf("%v did not finish", args)
+		}
+		full := make([]string, len(args))
+		copy(full, args)
+		for i, arg := range full {
+			if arg == "CURSOR" {
+				full[i] = cursor
+			}
+		}
+		got := call(full...)
+		if got.typ != ARRAY || len(got.array) != 2 {
+			t.Fatalf("%v = %+v, want [cursor items]", full, got)
+		}
+		for _, item := range got.array[1].array {
+			seen[string(item.bulk)]++
+		}
+		if cursor = string(got.array[0].bulk); cursor == "0" {
+			return seen
+		}
+	}
+}
+
+func TestScanCommands(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	for i := 0; i < 100; i++ {
+		call("SET", "str:"+strconv.Itoa(i), "v")
+	}
+	call("RPUSH", "list:1", "a")
+	call("HSET", "hash", "f1", "v1", "f2", "v2", "g1", "v3")
+
+	if seen := scanCommand(t, "SCAN", "CURSOR", "COUNT", "7"); len(seen) != 102 {
+		t.Errorf("SCAN returned %d keys, want 102", len(seen))
+	}
+	seen := scanCommand(t, "SCAN", "CURSOR", "MATCH", "str:1?")
+	if len(seen) != 10 || seen["str:15"] == 0 {
+		t.Errorf("SCAN MATCH str:1? = %v, want str:10..str:19", seen)
+	}
+	seen = scanCommand(t, "SCAN", "CURSOR", "TYPE", "list")
+	if len(seen) != 1 || seen["list:1"] == 0 {
+		t.Errorf("SCAN TYPE list = %v, want [list:1]", seen)
+	}
+	seen = scanCommand(t, "HSCAN", "hash", "CURSOR", "MATCH", "f*", "COUNT", "1")
+	if len(seen) != 4 || seen["f1"] != 1 || seen["v2"] != 1 || seen["g1"] != 0 {
+		t.Errorf("HSCAN hash MATCH f* = %v, want f1 v1 f2 v2", seen)
+	}
+	if got := call("KEYS", "[lh]*"); len(got.array) != 2 {
+		t.Errorf("KEYS [lh]* = %+v, want list:1 and hash", got)
+	}
+
+	for _, args := range [][]string{
+		{"SCAN", "-1"},
+		{"SCAN", "0", "COUNT", "0"},
+		{"SCAN", "0", "MATCH"},
+		{"HSCAN", "hash", "0", "TYPE", "hash"},
+		{"HSCAN", "list:1", "0"},
+	} {
+		if got := call(args...); got.typ != ERROR {
+			t.Errorf("%v = %+v, want an error", args, got)
+		}
+	}
+}
+
+func TestHScanAfterCopy(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	for i := 0; i < 100; i++ {
+		call("HSET", "h", "f"+strconv.Itoa(i), "v")
+	}
+	call("COPY", "h", "h2")
+	// 原 hash 新加的字段不会出现在复制出来的遍历索引里
+	for i := 100; i < 200; i++ {
+		call("HSET", "h", "f"+strconv.Itoa(i), "v")
+	}
+	if seen := scanCommand(t, "HSCAN", "h2", "CURSOR"); len(seen) != 101 {
+		t.Errorf("HSCAN h2 returned %d items, want 100 fields and the shared value", len(seen))
+	}
+	if seen := scanCommand(t, "HSCAN", "h", "CURSOR"); len(seen) != 201 {
+		t.Errorf("HSCAN h returned %d items, want 200 fields and the shared value", len(seen))
+	}
+}
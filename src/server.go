@@ -1,125 +1,509 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Server struct {
-	l                net.Listener
-	conns            []*ServerConnection
+	listeners  []net.Listener
+	conns      map[int64]*ServerConnection // 所有打开的连接，以连接编号为 key，连接关闭时移除
+	connsMu    sync.Mutex
+	unixSocket string // 监听的 Unix socket 路径，Close 时删除
+	closed     bool   // Close 之后监听器返回的错误不再当作异常
+
+	// execMu 每条命令执行时持有读锁，关闭时获取写锁，用来暂停新命令并等待正在执行的命令完成
+	execMu           sync.RWMutex
+	shutdownMu       sync.Mutex
+	shuttingDown     bool
+	shutdownAbort    chan struct{} // 等待命令执行完的阶段可以通过关闭这个 channel 取消关闭流程
 	keysExpiryTicker *time.Ticker
+	saveTicker       *time.Ticker
 }
 type ServerConnection struct {
-	con net.Conn
+	id     int64
+	server *Server // 连接所属的 Server，连接关闭时从 Server.conns 中移除；回放 AOF 时为 nil
+	con    net.Conn
+	resp   *Resp   // 整个连接共用一个读缓冲区，流水线中已经读进缓冲区的后续命令不会丢失
+	writer *Writer // 回复先写进缓冲区，读缓冲区处理完时再一起发送
+	proto  int     // 回复使用的 RESP 协议版本，默认为 2，通过 HELLO 切换
+	name   string  // HELLO SETNAME 设置的连接名称
+	db     int     // 当前选择的数据库
+
+	// aofCommand 命令写入 AOF 时使用的形式，为 nil 时写入客户端发来的原始命令，
+	// 由 propagate/skipPropagate 设置，每条命令执行完后清空
+	aofCommand *Value
 }
 
-func (s *Server) Start() {
-	l, err := net.Listen("tcp", "0.0.0.0:6379")
-	logger.Info("Listening on port: " + *port)
+// bindAddresses 解析 bind 配置，多个地址用空格分隔。
+// * 表示所有 IPv4 地址，::* 表示所有 IPv6 地址，以 - 开头的地址绑定失败时只打印警告；
+// 为空时监听所有地址（IPv4 和 IPv6）
+func bindAddresses(bind string) (hosts []string, optional []bool) {
+	fields := strings.Fields(bind)
+	if len(fields) == 0 {
+		return []string{""}, []bool{false}
+	}
+	for _, field := range fields {
+		isOptional := strings.HasPrefix(field, "-")
+		host := strings.TrimPrefix(field, "-")
+		switch host {
+		case "*":
+			host = "0.0.0.0"
+		case "::*":
+			host = "::"
+		}
+		hosts = append(hosts, host)
+		optional = append(optional, isOptional)
+	}
+	return hosts, optional
+}
+
+// listenNetwork IPv4 地址只监听 IPv4，IPv6 地址只监听 IPv6，这样 0.0.0.0 和 :: 可以同时绑定
+func listenNetwork(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// listen 按 bind 配置监听 port 和 tls-port，配置了 unixsocket 时再监听 Unix socket。
+// port 或 tls-port 为空时不监听对应的端口
+func (s *Server) listen() {
+	ConfigsMu.RLock()
+	bind, port, tlsPort := Configs["bind"], Configs["port"], Configs["tls-port"]
+	ConfigsMu.RUnlock()
+
+	if port != "" {
+		s.listenTCP(bind, "port", port, nil)
+	}
+	if tlsPort != "" {
+		s.listenTCP(bind, "tls-port", tlsPort, newTLSConfig())
+	}
+	s.listenUnix()
+	if len(s.listeners) == 0 {
+		logger.Fatal("Failed to listen on any address of bind %q", bind)
+	}
+}
 
-	// TCP 连接异常处理
+// listenTCP 在 bind 的每个地址上监听端口，tlsConfig 不为 nil 时监听 TLS 连接。
+// port 为 0 时由系统分配一个空闲端口，所有地址使用同一个端口，并把实际的端口写回 Configs[key]
+func (s *Server) listenTCP(bind, key, port string, tlsConfig *tls.Config) {
+	hosts, optional := bindAddresses(bind)
+	for i, host := range hosts {
+		addr := net.JoinHostPort(host, port)
+		l, err := net.Listen(listenNetwork(host), addr)
+		if err != nil {
+			if optional[i] {
+				logger.Warning("Failed to listen on %s (skipped): %s", addr, err.Error())
+				continue
+			}
+			logger.Fatal("Failed to listen on %s: %s", addr, err.Error())
+		}
+		if port == "0" {
+			_, port, _ = net.SplitHostPort(l.Addr().String())
+			ConfigsMu.Lock()
+			Configs[key] = port
+			ConfigsMu.Unlock()
+		}
+		if tlsConfig != nil {
+			logger.Info("Listening on %s (TLS)", l.Addr().String())
+			l = tls.NewListener(l, tlsConfig)
+		} else {
+			logger.Info("Listening on %s", l.Addr().String())
+		}
+		s.listeners = append(s.listeners, l)
+	}
+}
+
+// listenUnix 监听 unixsocket 配置的路径。上次没有正常退出留下的 socket 文件会先删除
+func (s *Server) listenUnix() {
+	ConfigsMu.RLock()
+	path, permStr := Configs["unixsocket"], Configs["unixsocketperm"]
+	ConfigsMu.RUnlock()
+	if path == "" {
+		return
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
 	if err != nil {
-		logger.Fatal("Failed to bind to port 6379")
-		os.Exit(1)
+		logger.Fatal("Failed to listen on unix socket %s: %s", path, err.Error())
 	}
-	s.l = l
-	// 每秒都触发一次，检查过期的 key
-	s.keysExpiryTicker = time.NewTicker(1 * time.Second)
+	if perm, _ := strconv.ParseUint(permStr, 8, 32); perm != 0 {
+		if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+			logger.Fatal("Failed to set permissions of unix socket %s: %s", path, err.Error())
+		}
+	}
+	logger.Info("Listening on unix socket %s", path)
+	s.listeners = append(s.listeners, l)
+	s.unixSocket = path
+}
+
+// 连接相关的限制，分别对应 maxclients、timeout（秒，0 表示不限制）和 tcp-keepalive（秒，0 表示关闭）配置，
+// 可以通过 CONFIG SET 修改，每个连接都会读取，所以使用原子变量
+var (
+	maxClients        atomic.Int64
+	clientIdleTimeout atomic.Int64
+	tcpKeepAlive      atomic.Int64
+)
+
+func (s *Server) Start() {
+	s.conns = map[int64]*ServerConnection{}
+	s.listen()
+
+	// 每 100 毫秒执行一次主动过期
+	s.keysExpiryTicker = time.NewTicker(activeExpireInterval)
 	go s.triggerActiveExpiryCheck()
+	// 每秒检查一次 save 规则，满足时触发 BGSAVE
+	s.saveTicker = time.NewTicker(1 * time.Second)
+	go s.triggerSaveCheck()
+	// SIGTERM/SIGINT 时关闭服务，关闭完成后所有监听器都已关闭，Start 返回
+	go s.handleSignals()
+
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			s.acceptLoop(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+func (s *Server) acceptLoop(l net.Listener) {
+	var delay time.Duration
 	for {
-		con, err := s.l.Accept()
+		con, err := l.Accept()
 		// 端口监听异常处理
 		if err != nil {
-			logger.Fatal("Error accepting connection: ", err.Error())
+			s.connsMu.Lock()
+			closed := s.closed
+			s.connsMu.Unlock()
+			if closed {
+				return
+			}
+			// 文件描述符用完这类暂时的错误等待之后重试，和 net/http 一样从 5ms 开始每次翻倍，最多 1s
+			if temporaryAcceptError(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				logger.Warning("Error accepting connection on %s: %s, retrying in %s", l.Addr().String(), err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			logger.Fatal("Error accepting connection on %s: %s", l.Addr().String(), err.Error())
 			os.Exit(1)
 		}
+		delay = 0
+		setKeepAlive(con)
 		serverCon := &ServerConnection{
-			con: con,
+			id:     nextClientID.Add(1),
+			server: s,
+			con:    con,
+			proto:  2,
+		}
+		s.connsMu.Lock()
+		full := int64(len(s.conns)) >= maxClients.Load()
+		if !full {
+			s.conns[serverCon.id] = serverCon
+		}
+		s.connsMu.Unlock()
+		if full {
+			go rejectConn(con, "ERR max number of clients reached")
+			continue
 		}
-		s.conns = append(s.conns, serverCon)
 		go serverCon.handler()
 	}
 }
+
+// temporaryAcceptError Accept 的错误是否只是暂时的，例如文件描述符用完（EMFILE/ENFILE），
+// 已有的连接关闭之后就可以恢复，不应该让服务器退出
+func temporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var tempErr interface{ Temporary() bool }
+	return errors.As(err, &tempErr) && tempErr.Temporary()
+}
+
+// setKeepAlive 按 tcp-keepalive 配置设置 TCP 连接的 keepalive，Unix socket 连接不需要
+func setKeepAlive(con net.Conn) {
+	if tlsConn, ok := con.(*tls.Conn); ok {
+		con = tlsConn.NetConn()
+	}
+	tcpConn, ok := con.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := tcpKeepAlive.Load()
+	if period <= 0 {
+		_ = tcpConn.SetKeepAlive(false)
+		return
+	}
+	_ = tcpConn.SetKeepAlive(true)
+	_ = tcpConn.SetKeepAlivePeriod(time.Duration(period) * time.Second)
+}
+
+// rejectConn 回复错误后关闭连接，写入最多等待 1 秒，不会因为客户端不读取而阻塞
+func rejectConn(con net.Conn, msg string) {
+	_ = con.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = con.Write(Value{typ: ERROR, str: msg}.Marshal())
+	_ = con.Close()
+}
+
+// removeConn 把关闭的连接从 conns 中移除
+func (s *Server) removeConn(sc *ServerConnection) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, sc.id)
+}
+
+// Close 停止监听并关闭所有客户端连接，重复调用直接返回
 func (s *Server) Close() {
-	_ = s.l.Close()
+	s.connsMu.Lock()
+	if s.closed {
+		s.connsMu.Unlock()
+		return
+	}
+	s.closed = true
+	conns := make([]*ServerConnection, 0, len(s.conns))
+	for _, sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.connsMu.Unlock()
+
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	for _, sc := range conns {
+		_ = sc.con.Close()
+	}
+	if s.unixSocket != "" {
+		if err := os.Remove(s.unixSocket); err != nil && !os.IsNotExist(err) {
+			logger.Warning("Failed to remove unix socket %s: %s", s.unixSocket, err.Error())
+		}
+	}
 }
 
+// triggerActiveExpiryCheck 定期执行主动过期，见 activeExpireCycle
 func (s *Server) triggerActiveExpiryCheck() {
 	defer s.keysExpiryTicker.Stop()
+	next := 0
 	for {
 		<-s.keysExpiryTicker.C
-		for key, val := range SETs {
-			if (val.ExpiryInMS.Before(time.Now()) && val.ExpiryInMS != time.Time{}) {
-				fmt.Printf("deleting key :%v", key)
-				delete(SETs, key)
-			}
-		}
+		next = activeExpireCycle(next)
+	}
+}
 
-		//for k1, entryMap := range HSETs {
-		//	for k2, _ := range entryMap {
-		//		if (entryMap[k2].ExpiryInMS.Before(time.Now()) && entryMap[k2].ExpiryInMS != time.Time{}) {
-		//			fmt.Printf("deleting key :%v", k2)
-		//			delete(entryMap, k2)
-		//		}
-		//	}
-		//	if len(entryMap) == 0 {
-		//		delete(HSETs, k1)
-		//	}
-		//}
+func (s *Server) triggerSaveCheck() {
+	defer s.saveTicker.Stop()
+	for {
+		<-s.saveTicker.C
+		rdbSaveIfNeeded()
 	}
 }
 
+// close 关闭连接并从 Server 中注销
+func (sc *ServerConnection) close() {
+	_ = sc.con.Close()
+	if sc.server != nil {
+		sc.server.removeConn(sc)
+	}
+}
+
+// handler 处理一个连接上的所有命令，客户端断开、读写出错或者协议错误时关闭连接并返回
 func (sc *ServerConnection) handler() {
+	defer sc.close()
+	// TLS 握手失败（例如客户端没有提供证书）或者超时时直接关闭连接
+	if tlsConn, ok := sc.con.(*tls.Conn); ok {
+		_ = sc.con.SetDeadline(time.Now().Add(handshakeTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warning("TLS handshake with %s failed: %s", sc.con.RemoteAddr().String(), err.Error())
+			return
+		}
+		_ = sc.con.SetDeadline(time.Time{})
+	}
+	sc.resp = NewResp(sc.con)
+	sc.writer = NewWriter(sc.con)
 	for {
-		conn := sc.con
-		resp := NewResp(conn)
-		value, err := resp.Read()
-
-		if err != nil {
-			if err != io.EOF {
-				logger.Error("error from reading client: ", err.Error())
+		// 客户端发来的命令都处理完了（读缓冲区为空）才真正发送回复，
+		// 这样流水线中的多个回复可以合并成一次写入
+		if sc.resp.Buffered() == 0 {
+			if err := sc.writer.Flush(); err != nil {
+				sc.writeError(err)
+				return
 			}
-			continue
 		}
-
-		if value.typ != "array" {
-			logger.Error("Invalid request, expected array")
-			continue
+		sc.setIdleDeadline()
+		value, err := sc.resp.ReadCommand()
+		if err != nil {
+			sc.readError(err)
+			return
 		}
 
+		// 和 Redis 一样忽略空数组
 		if len(value.array) == 0 {
-			logger.Error("Invalid request, expected array length > 0")
 			continue
 		}
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+		command := strings.ToUpper(string(value.array[0].bulk))
 
 		logger.Debug("从客户端接收到的数据：")
-		logger.Debug(fmt.Sprintf("%+v", value))
-
-		writer := NewWriter(conn)
+		logger.Debug(fmt.Sprintf("%q", commandArgs(value)))
 
 		// 处理命令
 		handle, ok := Handlers[command]
 		if !ok {
-			err := writer.Write(Value{typ: ERROR, str: "Invalid command: " + command})
-			if err != nil {
-				logger.Error("error: ", err.Error())
+			if err := sc.writer.Write(Value{typ: ERROR, str: "Invalid command: " + command}, sc.proto); err != nil {
+				sc.writeError(err)
 				return
 			}
 			continue
 		}
 
+		// 关闭流程会暂停执行新的命令，SHUTDOWN 自身（包括 SHUTDOWN ABORT）不受影响
+		var result Value
+		if command == "SHUTDOWN" || sc.server == nil {
+			result = sc.execute(command, handle, value)
+		} else {
+			sc.server.execMu.RLock()
+			result = sc.execute(command, handle, value)
+			sc.server.execMu.RUnlock()
+		}
+
 		// 向 redis Client 回写数据
-		err = writer.Write(handle(args))
-		if err != nil {
-			logger.Error("error: ", err.Error())
+		if err := sc.writer.Write(result, sc.proto); err != nil {
+			sc.writeError(err)
 			return
 		}
 	}
 }
+
+// execute 执行一条命令。写命令在 writeMu 中执行，执行成功后在释放锁之前追加到 AOF，
+// 这样 AOF 中命令的顺序和它们修改数据的顺序一致
+func (sc *ServerConnection) execute(command string, handle func(sc *ServerConnection, args []Value) Value, value Value) Value {
+	if !WriteCommands[command] {
+		return sc.run(command, handle, value.array[1:])
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	sc.aofCommand = nil
+	result := sc.run(command, handle, value.array[1:])
+	aofCommand := value
+	if sc.aofCommand != nil {
+		aofCommand, sc.aofCommand = *sc.aofCommand, nil
+	}
+	if AOF != nil && result.typ != ERROR && len(aofCommand.array) > 0 {
+		if err := AOF.Write(sc.db, aofCommand); err != nil {
+			logger.Error("error writing AOF: %s", err.Error())
+		}
+	}
+	return result
+}
+
+// run 调用命令的处理函数。处理函数 panic 时记录日志并返回错误，一条命令的 bug 不会让整个服务器退出
+func (sc *ServerConnection) run(command string, handle func(sc *ServerConnection, args []Value) Value, args []Value) (result Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("panic while executing %s: %v\n%s", command, r, debug.Stack())
+			result = Value{typ: ERROR, str: "ERR internal error while executing '" + strings.ToLower(command) + "' command"}
+		}
+	}()
+	return handle(sc, args)
+}
+
+// commandArgs 命令的各个参数，批量字符串是 []byte，直接打印 Value 只能看到字节的数值
+func commandArgs(value Value) []string {
+	args := make([]string, len(value.array))
+	for i, arg := range value.array {
+		args[i] = string(arg.bulk)
+	}
+	return args
+}
+
+// propagate 用 args 代替客户端发来的原始命令写入 AOF，
+// 用于把相对的过期时间等回放时会变化的参数换成确定的值
+func (sc *ServerConnection) propagate(args ...string) {
+	sc.aofCommand = &Value{typ: ARRAY, array: bulks(args...)}
+}
+
+// skipPropagate 命令没有修改任何数据，不需要写入 AOF
+func (sc *ServerConnection) skipPropagate() {
+	sc.aofCommand = &Value{typ: ARRAY}
+}
+
+// readError 处理读请求时的错误。协议错误先回复 -ERR Protocol error 再关闭连接，
+// 客户端正常断开（EOF）时直接关闭
+func (sc *ServerConnection) readError(err error) {
+	var protoErr *ProtocolError
+	switch {
+	case errors.As(err, &protoErr):
+		logger.Warning("Protocol error from client %s: %s", sc.con.RemoteAddr().String(), protoErr.msg)
+		_ = sc.writer.Write(Value{typ: ERROR, str: "ERR " + protoErr.Error()}, sc.proto)
+		_ = sc.writer.Flush()
+	case err == io.EOF, errors.Is(err, net.ErrClosed):
+		// 客户端断开，或者关闭服务时连接已经被关闭
+	case isTimeout(err):
+		logger.Info("Closing idle client %s", sc.con.RemoteAddr().String())
+	default:
+		logger.Error("error from reading client %s: %s", sc.con.RemoteAddr().String(), err.Error())
+	}
+}
+
+// writeError 记录写回复时的错误，关闭服务时连接已经被关闭，不需要记录
+func (sc *ServerConnection) writeError(err error) {
+	if !errors.Is(err, net.ErrClosed) {
+		logger.Error("error writing to client %s: %s", sc.con.RemoteAddr().String(), err.Error())
+	}
+}
+
+// setIdleDeadline 设置读取下一条命令的超时时间，超过 timeout 秒没有收到命令的连接会被关闭
+func (sc *ServerConnection) setIdleDeadline() {
+	deadline := time.Time{}
+	if timeout := clientIdleTimeout.Load(); timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	_ = sc.con.SetReadDeadline(deadline)
+}
+
+// tlsHandshakeTimeout TLS 握手的最长时间，没有设置 timeout 时也不能让不发送 ClientHello 的连接一直占用名额
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshakeTimeout TLS 握手的超时时间，取 timeout 配置和 tlsHandshakeTimeout 中较小的一个
+func handshakeTimeout() time.Duration {
+	timeout := time.Duration(clientIdleTimeout.Load()) * time.Second
+	if timeout <= 0 || timeout > tlsHandshakeTimeout {
+		return tlsHandshakeTimeout
+	}
+	return timeout
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
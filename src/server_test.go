@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testClient 通过 net.Pipe 连接到一个 ServerConnection，按原始字节收发 RESP
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	done chan struct{} // handler 返回时关闭
+}
+
+// newTestClient 创建一个连接，测试结束时关闭连接并等待 handler 返回
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+	client, server := net.Pipe()
+	sc := &ServerConnection{con: server, proto: 2}
+	c := &testClient{t: t, conn: client, r: bufio.NewReader(client), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		sc.handler()
+	}()
+	t.Cleanup(func() {
+		_ = client.Close()
+		c.waitClosed()
+	})
+	return c
+}
+
+// waitClosed 等待服务端关闭连接
+func (c *testClient) waitClosed() {
+	c.t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("handler did not return")
+	}
+}
+
+// expectClosed 检查服务端已经关闭了连接
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := c.readReply(); err != io.EOF {
+		c.t.Errorf("read = %q, %v, want EOF", reply, err)
+	}
+	c.waitClosed()
+}
+
+// send 原样发送 data
+func (c *testClient) send(data string) {
+	c.t.Helper()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("write %q: %v", data, err)
+	}
+}
+
+// reply 读取一个完整的回复，按收到的原始字节返回
+func (c *testClient) reply() string {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := c.readReply()
+	if err != nil {
+		c.t.Fatalf("read reply: %v (got %q)", err, reply)
+	}
+	return reply
+}
+
+func (c *testClient) readReply() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return line, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return line, fmt.Errorf("malformed line %q", line)
+	}
+	n, _ := strconv.Atoi(line[1 : len(line)-2])
+	switch line[0] {
+	case '$', '=':
+		if n < 0 {
+			return line, nil
+		}
+		buf := make([]byte, n+2)
+		_, err := io.ReadFull(c.r, buf)
+		return line + string(buf), err
+	case '*', '~', '>', '%', '|':
+		// map 和 attribute 头部的数量是键值对的个数
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+		reply := line
+		for i := 0; i < n; i++ {
+			element, err := c.readReply()
+			reply += element
+			if err != nil {
+				return reply, err
+			}
+		}
+		return reply, nil
+	default:
+		return line, nil
+	}
+}
+
+// bulkReply 批量字符串回复的编码
+func bulkReply(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// do 发送一条命令并返回回复
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(string(command(args...).Marshal()))
+	return c.reply()
+}
+
+func TestPipelinedReplies(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+	c := newTestClient(t)
+
+	// 一次写入多条命令，回复按顺序返回
+	var pipeline strings.Builder
+	for i := 0; i < 200; i++ {
+		pipeline.Write(command("SET", "key"+strconv.Itoa(i), strconv.Itoa(i)).Marshal())
+		pipeline.Write(command("GET", "key"+strconv.Itoa(i)).Marshal())
+	}
+	pipeline.Write(command("PING").Marshal())
+	// net.Pipe 没有缓冲，回复可能在命令还没写完时就开始发送，所以在另一个 goroutine 中写
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.conn.Write([]byte(pipeline.String()))
+		done <- err
+	}()
+	for i := 0; i < 200; i++ {
+		if got := c.reply(); got != "+OK\r\n" {
+			t.Fatalf("reply to SET %d = %q", i, got)
+		}
+		value := strconv.Itoa(i)
+		if got, want := c.reply(), bulkReply(value); got != want {
+			t.Fatalf("reply to GET %d = %q, want %q", i, got, want)
+		}
+	}
+	if got := c.reply(); got != "+PONG\r\n" {
+		t.Errorf("reply to PING = %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 一条命令分多次写入，批量字符串被拆开也能读完整
+	cmd := string(command("ECHO", "hello").Marshal())
+	for i := 0; i < len(cmd); i += 3 {
+		end := i + 3
+		if end > len(cmd) {
+			end = len(cmd)
+		}
+		c.send(cmd[i:end])
+	}
+	if got := c.reply(); got != bulkReply("hello") {
+		t.Errorf("reply to split ECHO = %q", got)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"bulk length", "*1\r\n$x\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"negative bulk length", "*1\r\n$-1\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"bulk too large", "*1\r\n$536870913\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"multibulk length", "*x\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"multibulk too large", "*1048577\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"expected bulk", "*1\r\n:1\r\n", "-ERR Protocol error: expected '$', got ':'\r\n"},
+		{"missing newline", "*1\r\n$4\r\nPING\rx", "-ERR Protocol error: expected CRLF after bulk string\r\n"},
+		{"line too long", "*1\r\n$" + strings.Repeat("1", 64*1024+1) + "\r\n", "-ERR Protocol error: too big count string\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			done := make(chan struct{})
+			// 服务端可能在读完请求之前就回复错误并关闭连接，写入放在另一个 goroutine
+			go func() {
+				defer close(done)
+				_, _ = c.conn.Write([]byte(tt.request))
+			}()
+			if got := c.reply(); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+			// 协议错误之后服务端关闭连接
+			c.expectClosed()
+			_ = c.conn.Close()
+			<-done
+		})
+	}
+}
+
+func TestCloseOnEOF(t *testing.T) {
+	c := newTestClient(t)
+	if got := c.do("PING"); got != "+PONG\r\n" {
+		t.Fatalf("PING = %q", got)
+	}
+	// 空数组被忽略，连接保持打开
+	c.send("*0\r\n")
+	if got := c.do("PING"); got != "+PONG\r\n" {
+		t.Fatalf("PING after an empty array = %q", got)
+	}
+	_ = c.conn.Close()
+	c.waitClosed()
+}
+
+func TestInlineCommands(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+	c := newTestClient(t)
+
+	c.send("PING\r\n")
+	if got := c.reply(); got != "+PONG\r\n" {
+		t.Errorf("inline PING = %q", got)
+	}
+	// 只有 \n 结尾也可以，空行被忽略
+	c.send("\r\n  set k \"a b\"\n")
+	if got := c.reply(); got != "+OK\r\n" {
+		t.Errorf("inline SET = %q", got)
+	}
+	if got := c.do("GET", "k"); got != bulkReply("a b") {
+		t.Errorf("GET k = %q, want the quoted value", got)
+	}
+
+	c.send("ECHO \"unterminated\r\n")
+	if got := c.reply(); got != "-ERR Protocol error: unbalanced quotes in request\r\n" {
+		t.Errorf("unbalanced quotes = %q", got)
+	}
+	c.expectClosed()
+}
+
+func TestHello(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+	c := newTestClient(t)
+
+	if got := c.do("HELLO", "4"); got != "-NOPROTO unsupported protocol version\r\n" {
+		t.Errorf("HELLO 4 = %q", got)
+	}
+	if got := c.do("HELLO", "x"); !strings.HasPrefix(got, "-ERR Protocol version is not an integer") {
+		t.Errorf("HELLO x = %q", got)
+	}
+	// RESP2 下 null 是空的批量字符串
+	if got := c.do("GET", "missing"); got != "$-1\r\n" {
+		t.Errorf("GET missing with RESP2 = %q", got)
+	}
+
+	// HELLO 的回复本身已经使用 RESP3 编码
+	got := c.do("HELLO", "3", "SETNAME", "conn")
+	if !strings.HasPrefix(got, "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n") || !strings.Contains(got, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("HELLO 3 = %q, want a RESP3 map with proto 3", got)
+	}
+	if got := c.do("GET", "missing"); got != "_\r\n" {
+		t.Errorf("GET missing with RESP3 = %q", got)
+	}
+	if got := c.do("HELLO", "2"); !strings.HasPrefix(got, "*14\r\n") {
+		t.Errorf("HELLO 2 = %q, want a flat array", got)
+	}
+	if got := c.do("GET", "missing"); got != "$-1\r\n" {
+		t.Errorf("GET missing after HELLO 2 = %q", got)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+	c := newTestClient(t)
+
+	value := "a\x00\xff\r\nb"
+	if got := c.do("SET", "k", value); got != "+OK\r\n" {
+		t.Fatalf("SET = %q", got)
+	}
+	if got := c.do("GET", "k"); got != bulkReply(value) {
+		t.Errorf("GET = %q, want %q", got, bulkReply(value))
+	}
+	c.do("HSET", "h", "f", value)
+	if got := c.do("HGET", "h", "f"); got != bulkReply(value) {
+		t.Errorf("HGET = %q, want %q", got, bulkReply(value))
+	}
+	if got := c.do("ECHO", value); got != bulkReply(value) {
+		t.Errorf("ECHO = %q, want %q", got, bulkReply(value))
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	old := clientIdleTimeout.Load()
+	t.Cleanup(func() { clientIdleTimeout.Store(old) })
+
+	for _, tt := range []struct {
+		timeout int64
+		want    time.Duration
+	}{
+		{0, tlsHandshakeTimeout},
+		{3, 3 * time.Second},
+		{3600, tlsHandshakeTimeout},
+	} {
+		clientIdleTimeout.Store(tt.timeout)
+		if got := handshakeTimeout(); got != tt.want {
+			t.Errorf("handshakeTimeout() with timeout %d = %v, want %v", tt.timeout, got, tt.want)
+		}
+	}
+
+	// 客户端连上之后一直不发送 ClientHello，握手超时后连接要被关闭
+	clientIdleTimeout.Store(1)
+	client, server := net.Pipe()
+	defer client.Close()
+	sc := &ServerConnection{con: tls.Server(server, &tls.Config{}), proto: 2}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc.handler()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the TLS handshake timed out")
+	}
+}
+
+func TestEchoArity(t *testing.T) {
+	c := newTestClient(t)
+	for _, args := range [][]string{{"ECHO"}, {"ECHO", "a", "b"}} {
+		if got := c.do(args...); got != "-ERR wrong number of arguments for 'echo' command\r\n" {
+			t.Errorf("%v = %q", args, got)
+		}
+	}
+	if got := c.do("ECHO", "a"); got != "$1\r\na\r\n" {
+		t.Errorf("ECHO a = %q", got)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+	panicking := func(sc *ServerConnection, args []Value) Value {
+		panic("boom")
+	}
+	Handlers["TESTPANIC"], Handlers["TESTWRITEPANIC"] = panicking, panicking
+	WriteCommands["TESTWRITEPANIC"] = true
+	t.Cleanup(func() {
+		delete(Handlers, "TESTPANIC")
+		delete(Handlers, "TESTWRITEPANIC")
+		delete(WriteCommands, "TESTWRITEPANIC")
+	})
+
+	// panic 的命令返回错误，连接和其他命令照常工作，写命令的锁也被释放
+	c := newTestClient(t)
+	if got := c.do("TESTPANIC"); got != "-ERR internal error while executing 'testpanic' command\r\n" {
+		t.Errorf("TESTPANIC = %q", got)
+	}
+	if got := c.do("TESTWRITEPANIC"); !strings.HasPrefix(got, "-ERR internal error") {
+		t.Errorf("TESTWRITEPANIC = %q", got)
+	}
+	if got := c.do("SET", "k", "v"); got != "+OK\r\n" {
+		t.Errorf("SET after a panic = %q", got)
+	}
+	if got := c.do("GET", "k"); got != "$1\r\nv\r\n" {
+		t.Errorf("GET after a panic = %q", got)
+	}
+}
+
+// flakyListener 先依次返回 errs 中的错误，再返回 conns 中的连接，conns 关闭之后返回 net.ErrClosed
+type flakyListener struct {
+	errs  []error
+	conns chan net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	con, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return con, nil
+}
+
+func (l *flakyListener) Close() error   { return nil }
+func (l *flakyListener) Addr() net.Addr { return &net.UnixAddr{Name: "flaky", Net: "unix"} }
+
+func TestAcceptTemporaryErrors(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{emfile, true},
+		{os.NewSyscallError("accept", syscall.ENFILE), true},
+		{net.ErrClosed, false},
+		{errors.New("accept failed"), false},
+	} {
+		if got := temporaryAcceptError(tt.err); got != tt.want {
+			t.Errorf("temporaryAcceptError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	// 文件描述符用完之后 acceptLoop 继续接受新的连接，而不是退出
+	old := maxClients.Load()
+	maxClients.Store(10)
+	t.Cleanup(func() { maxClients.Store(old) })
+	s := &Server{conns: map[int64]*ServerConnection{}}
+	l := &flakyListener{errs: []error{emfile, emfile}, conns: make(chan net.Conn)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.acceptLoop(l)
+	}()
+	client, server := net.Pipe()
+	l.conns <- server
+	c := &testClient{t: t, conn: client, r: bufio.NewReader(client)}
+	if got := c.do("PING"); got != "+PONG\r\n" {
+		t.Errorf("PING after EMFILE = %q", got)
+	}
+	_ = client.Close()
+
+	s.connsMu.Lock()
+	s.closed = true
+	s.connsMu.Unlock()
+	close(l.conns)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acceptLoop did not return after the listener was closed")
+	}
+}
+
+func TestCapMaxClients(t *testing.T) {
+	for _, tt := range []struct {
+		maxclients int64
+		limit      uint64
+		want       int64
+	}{
+		{10000, math.MaxUint64, 10000},
+		{10000, 10000 + reservedFDs, 10000},
+		{10000, 1024, 1024 - reservedFDs},
+		{10000, reservedFDs, 0},
+	} {
+		if got := capMaxClients(tt.maxclients, tt.limit); got != tt.want {
+			t.Errorf("capMaxClients(%d, %d) = %d, want %d", tt.maxclients, tt.limit, got, tt.want)
+		}
+	}
+
+	// CONFIG SET 同样不能超过文件描述符的限制
+	limit, ok := openFileLimit()
+	if !ok || limit > math.MaxInt64/2 {
+		return
+	}
+	old := maxClients.Load()
+	t.Cleanup(func() { maxClients.Store(old) })
+	if got := call("CONFIG", "SET", "maxclients", strconv.FormatUint(limit, 10)); got.typ != ERROR {
+		t.Errorf("CONFIG SET maxclients above the open file limit = %+v, want an error", got)
+	}
+	if got := call("CONFIG", "SET", "maxclients", "1"); text(got) != "OK" {
+		t.Errorf("CONFIG SET maxclients 1 = %+v", got)
+	}
+}
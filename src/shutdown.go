@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownOptions SHUTDOWN 命令的参数，收到 SIGTERM/SIGINT 时使用默认值
+type shutdownOptions struct {
+	save   bool // SAVE：即使没有配置 save 规则也保存快照
+	noSave bool // NOSAVE：不保存快照
+	now    bool // NOW：不等待正在执行的命令
+	force  bool // FORCE：保存快照或者关闭 AOF 出错时也退出
+}
+
+var (
+	errShutdownInProgress = errors.New("ERR Shutdown already in progress")
+	errShutdownAborted    = errors.New("ERR Shutdown was aborted")
+	errShutdownFailed     = errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+)
+
+// Shutdown 关闭服务，依次执行：
+//  1. 暂停执行新的命令，等待正在执行的命令完成，最多等待 shutdown-timeout 秒（NOW 不等待），
+//     这期间可以用 SHUTDOWN ABORT 取消
+//  2. 配置了 save 规则或者指定了 SAVE 时保存快照（NOSAVE 不保存）
+//  3. 把 AOF 刷盘并关闭
+//  4. 停止监听、关闭所有连接，Start 返回后进程以 0 退出
+//
+// 第 2、3 步出错时放弃关闭、恢复执行命令并返回错误，FORCE 时忽略错误继续关闭
+func (s *Server) Shutdown(opts shutdownOptions) error {
+	s.shutdownMu.Lock()
+	if s.shuttingDown {
+		s.shutdownMu.Unlock()
+		return errShutdownInProgress
+	}
+	abort := make(chan struct{})
+	s.shuttingDown, s.shutdownAbort = true, abort
+	s.shutdownMu.Unlock()
+
+	logger.Warning("User requested shutdown...")
+	release, err := s.pauseCommands(opts.now, abort)
+	// 等待结束后不能再取消
+	s.shutdownMu.Lock()
+	s.shutdownAbort = nil
+	s.shutdownMu.Unlock()
+	if err == nil {
+		err = s.finalizeShutdown(opts)
+	}
+	if err != nil {
+		release()
+		s.shutdownMu.Lock()
+		s.shuttingDown = false
+		s.shutdownMu.Unlock()
+		return err
+	}
+
+	// Close 之后 Start 返回，main 随即退出，所以先打印日志
+	logger.Warning("Redis is now ready to exit, bye bye...")
+	s.Close()
+	return nil
+}
+
+// pauseCommands 阻止新命令开始执行，并等待正在执行的命令结束。
+// 返回的 release 恢复执行命令，在取消或者关闭失败时调用
+func (s *Server) pauseCommands(now bool, abort chan struct{}) (release func(), err error) {
+	acquired := make(chan struct{})
+	go func() {
+		s.execMu.Lock()
+		close(acquired)
+	}()
+	release = func() {
+		go func() {
+			<-acquired
+			s.execMu.Unlock()
+		}()
+	}
+
+	ConfigsMu.RLock()
+	timeout, _ := strconv.Atoi(Configs["shutdown-timeout"])
+	ConfigsMu.RUnlock()
+	if now {
+		timeout = 0
+	}
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-acquired:
+	case <-timer.C:
+		logger.Warning("Commands still running after %d seconds, shutting down anyway", timeout)
+	case <-abort:
+		logger.Warning("Shutdown aborted by SHUTDOWN ABORT")
+		return release, errShutdownAborted
+	}
+	return release, nil
+}
+
+// finalizeShutdown 保存快照并关闭 AOF
+func (s *Server) finalizeShutdown(opts shutdownOptions) error {
+	ConfigsMu.RLock()
+	doSave := strings.TrimSpace(Configs["save"]) != ""
+	ConfigsMu.RUnlock()
+	if opts.save {
+		doSave = true
+	}
+	if opts.noSave {
+		doSave = false
+	}
+
+	if doSave {
+		logger.Info("Saving the final RDB snapshot before exiting.")
+		if err := rdbSave(takeRdbSnapshot()); err != nil {
+			if !opts.force {
+				logger.Error("Error trying to save the DB, can't exit.")
+				return errShutdownFailed
+			}
+			logger.Warning("Error trying to save the DB, exiting anyway (FORCE)")
+		}
+	}
+	if AOF != nil {
+		logger.Info("Calling fsync() on the AOF file.")
+		if err := AOF.Close(); err != nil {
+			if !opts.force {
+				logger.Error("Error closing the AOF: %s, can't exit.", err.Error())
+				return errShutdownFailed
+			}
+			logger.Warning("Error closing the AOF: %s, exiting anyway (FORCE)", err.Error())
+		}
+	}
+	return nil
+}
+
+// abortShutdown 取消正在等待命令执行完的关闭流程，已经开始保存快照之后不能取消
+func (s *Server) abortShutdown() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	if s.shutdownAbort == nil {
+		return false
+	}
+	close(s.shutdownAbort)
+	s.shutdownAbort = nil
+	return true
+}
+
+// handleSignals 收到 SIGTERM 或 SIGINT 时按默认参数关闭，失败时继续运行
+func (s *Server) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		logger.Warning("Received %s scheduling shutdown...", sig.String())
+		if err := s.Shutdown(shutdownOptions{}); err != nil {
+			logger.Error("%s", err.Error())
+		}
+	}
+}
+
+// shutdown SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+func shutdown(sc *ServerConnection, args []Value) Value {
+	var opts shutdownOptions
+	abort := false
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg.bulk)) {
+		case "NOSAVE":
+			opts.noSave = true
+		case "SAVE":
+			opts.save = true
+		case "NOW":
+			opts.now = true
+		case "FORCE":
+			opts.force = true
+		case "ABORT":
+			abort = true
+		default:
+			return Value{typ: ERROR, str: "ERR syntax error"}
+		}
+	}
+	if (opts.save && opts.noSave) || (abort && len(args) > 1) {
+		return Value{typ: ERROR, str: "ERR syntax error"}
+	}
+	if sc.server == nil {
+		return Value{typ: ERROR, str: "ERR SHUTDOWN is not allowed here"}
+	}
+
+	if abort {
+		if !sc.server.abortShutdown() {
+			return Value{typ: ERROR, str: "ERR No shutdown in progress."}
+		}
+		return Value{typ: STRING, str: "OK"}
+	}
+	if err := sc.server.Shutdown(opts); err != nil {
+		return Value{typ: ERROR, str: err.Error()}
+	}
+	// 关闭成功时连接已经被关闭，这个回复不会发出
+	return Value{typ: STRING, str: "OK"}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// key 的数据类型，和 TYPE 命令的返回值一致
+const (
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+// WrongTypeError 对 key 执行了不适用于它的类型的命令
+var WrongTypeError = Value{typ: ERROR, str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+
+// Entry 键空间中的一个 key，字符串和 hash 的值使用 []byte 保存，可以是任意字节序列。
+// Value 的具体类型由 Type 决定：
+//
+//	TypeString -> []byte
+//	TypeHash   -> *Hash
+//	TypeList   -> []string
+//	TypeSet    -> map[string]struct{}
+//	TypeZSet   -> map[string]float64
+type Entry struct {
+	Type        string
+	Value       any
+	TimeCreated time.Time
+	ExpiryInMS  time.Time
+}
+
+// expired key 设置了过期时间并且已经过期
+func (e *Entry) expired(now time.Time) bool {
+	return (e.ExpiryInMS != time.Time{}) && !e.ExpiryInMS.After(now)
+}
+
+// clone 复制一份 Entry，容器类型的值也会复制，修改副本不会影响原来的 Entry
+func (e *Entry) clone() *Entry {
+	copied := *e
+	switch value := e.Value.(type) {
+	case []byte:
+		copied.Value = append([]byte(nil), value...)
+	case *Hash:
+		copied.Value = value.clone()
+	case []string:
+		copied.Value = append([]string(nil), value...)
+	case map[string]struct{}:
+		m := make(map[string]struct{}, len(value))
+		for k := range value {
+			m[k] = struct{}{}
+		}
+		copied.Value = m
+	case map[string]float64:
+		m := make(map[string]float64, len(value))
+		for k, v := range value {
+			m[k] = v
+		}
+		copied.Value = m
+	}
+	return &copied
+}
+
+// Hash TypeHash 的值。Fields 保存字段和值，Index 是 HSCAN 使用的遍历索引，
+// 加入字段要通过 set 保证两者一致。零值是一个可以读取的空 hash
+type Hash struct {
+	Fields map[string][]byte
+	Index  scanTable
+}
+
+func newHash(size int) *Hash {
+	return &Hash{Fields: make(map[string][]byte, size)}
+}
+
+// set 写入一个字段，返回字段是否是新加入的
+func (h *Hash) set(field string, value []byte) bool {
+	_, exists := h.Fields[field]
+	if !exists {
+		h.Index.add(field)
+	}
+	h.Fields[field] = value
+	return !exists
+}
+
+// clone 复制字段、值和遍历索引
+func (h *Hash) clone() *Hash {
+	fields := make(map[string][]byte, len(h.Fields))
+	for k, v := range h.Fields {
+		fields[k] = append([]byte(nil), v...)
+	}
+	return &Hash{Fields: fields, Index: h.Index.clone()}
+}
+
+// STORAGE 存储所有类型的数据，同一个 key 只能有一种类型。
+// Expires 是设置了过期时间的 key 的索引，主动过期只在这里面抽样；Keys 是 SCAN 使用的遍历索引。
+// 修改 Data 时要通过 set/remove 保证三者一致
+type STORAGE struct {
+	Data    map[string]*Entry
+	Expires map[string]struct{}
+	Keys    scanTable
+	Mu      sync.RWMutex
+}
+
+// databases 所有的逻辑数据库，数量由 databases 配置决定，下标就是 SELECT 使用的编号
+var databases []*STORAGE
+
+func initDatabases(n int) {
+	databases = make([]*STORAGE, n)
+	for i := range databases {
+		databases[i] = &STORAGE{Data: map[string]*Entry{}, Expires: map[string]struct{}{}}
+	}
+}
+
+// database 连接当前选择的数据库
+func (sc *ServerConnection) database() *STORAGE {
+	return databases[sc.db]
+}
+
+// lockDatabases 同时锁住两个数据库，总是先锁编号小的，避免死锁
+func lockDatabases(a, b int) func() {
+	if a > b {
+		a, b = b, a
+	}
+	databases[a].Mu.Lock()
+	databases[b].Mu.Lock()
+	return func() {
+		databases[b].Mu.Unlock()
+		databases[a].Mu.Unlock()
+	}
+}
+
+// set 写入或替换一个 key，并按 entry 是否有过期时间更新 Expires，调用方需要持有写锁
+func (s *STORAGE) set(key string, entry *Entry) {
+	if _, exists := s.Data[key]; !exists {
+		s.Keys.add(key)
+	}
+	s.Data[key] = entry
+	if (entry.ExpiryInMS != time.Time{}) {
+		s.Expires[key] = struct{}{}
+	} else {
+		delete(s.Expires, key)
+	}
+}
+
+// remove 删除一个 key，调用方需要持有写锁
+func (s *STORAGE) remove(key string) {
+	if _, exists := s.Data[key]; exists {
+		s.Keys.remove(key)
+	}
+	delete(s.Data, key)
+	delete(s.Expires, key)
+}
+
+// lookup 查找一个没有过期的 key，调用方需要持有 Mu
+func (s *STORAGE) lookup(key string) (*Entry, bool) {
+	entry, ok := s.Data[key]
+	if !ok || entry.expired(time.Now()) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// lookupForWrite 查找 key 用于写入，已经过期的 key 会被删除，调用方需要持有写锁
+func (s *STORAGE) lookupForWrite(key string) (*Entry, bool) {
+	entry, ok := s.Data[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(time.Now()) {
+		s.remove(key)
+		dirty.Add(1)
+		return nil, false
+	}
+	return entry, true
+}
+
+// snapshotDatabases 复制所有数据库的数据，下标是数据库编号。调用方需要持有 writeMu，
+// 否则 MOVE 这样同时修改两个数据库的命令可能只有一半出现在快照里
+func snapshotDatabases() []map[string]*Entry {
+	dbs := make([]map[string]*Entry, len(databases))
+	for i, db := range databases {
+		dbs[i] = db.snapshot()
+	}
+	return dbs
+}
+
+// snapshot 复制一份所有的数据，供 AOF 重写、RDB 保存等后台任务在不持有锁的情况下遍历
+func (s *STORAGE) snapshot() map[string]*Entry {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	data := make(map[string]*Entry, len(s.Data))
+	for key, entry := range s.Data {
+		data[key] = entry.clone()
+	}
+	return data
+}
+
+// parseDBIndex 解析数据库编号，超出范围时返回对应的错误
+func parseDBIndex(arg string) (int, *Value) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, &Value{typ: ERROR, str: "ERR value is not an integer or out of range"}
+	}
+	if index < 0 || index >= len(databases) {
+		return 0, &Value{typ: ERROR, str: "ERR DB index is out of range"}
+	}
+	return index, nil
+}
+
+func selectDB(sc *ServerConnection, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'select' command"}
+	}
+	index, errValue := parseDBIndex(string(args[0].bulk))
+	if errValue != nil {
+		return *errValue
+	}
+	sc.db = index
+	return Value{typ: STRING, str: "OK"}
+}
+
+// move MOVE key db，目标库中已经存在同名 key 时不移动
+func move(sc *ServerConnection, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'move' command"}
+	}
+	key := string(args[0].bulk)
+	target, errValue := parseDBIndex(string(args[1].bulk))
+	if errValue != nil {
+		return *errValue
+	}
+	if target == sc.db {
+		return Value{typ: ERROR, str: "ERR source and destination objects are the same"}
+	}
+
+	unlock := lockDatabases(sc.db, target)
+	defer unlock()
+	src, dst := databases[sc.db], databases[target]
+	entry, ok := src.lookupForWrite(key)
+	if !ok {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	if _, exists := dst.lookupForWrite(key); exists {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	src.remove(key)
+	dst.set(key, entry)
+	dirty.Add(1)
+	return Value{typ: INTEGER, num: 1}
+}
+
+// delGeneric DEL/UNLINK key [key ...]，返回删除的 key 数量。
+// 删除只是从 map 中去掉引用，值占用的内存由 GC 在后台回收，大的 key 也不会阻塞其它命令，
+// 所以 UNLINK 和 DEL 的实现相同
+func delGeneric(sc *ServerConnection, args []Value, name string) Value {
+	if len(args) == 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	deleted := 0
+	for _, arg := range args {
+		key := string(arg.bulk)
+		if _, ok := db.lookupForWrite(key); ok {
+			db.remove(key)
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		sc.skipPropagate()
+	}
+	dirty.Add(int64(deleted))
+	return Value{typ: INTEGER, num: deleted}
+}
+
+func del(sc *ServerConnection, args []Value) Value {
+	return delGeneric(sc, args, "del")
+}
+
+func unlink(sc *ServerConnection, args []Value) Value {
+	return delGeneric(sc, args, "unlink")
+}
+
+// countKeys EXISTS/TOUCH key [key ...]，返回存在的 key 数量，重复的 key 重复计数
+func countKeys(sc *ServerConnection, args []Value, name string) Value {
+	if len(args) == 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	count := 0
+	for _, arg := range args {
+		if _, ok := db.lookup(string(arg.bulk)); ok {
+			count++
+		}
+	}
+	return Value{typ: INTEGER, num: count}
+}
+
+func exists(sc *ServerConnection, args []Value) Value {
+	return countKeys(sc, args, "exists")
+}
+
+// touch 没有 LRU/LFU 淘汰，访问时间不需要更新，只返回存在的 key 数量
+func touch(sc *ServerConnection, args []Value) Value {
+	return countKeys(sc, args, "touch")
+}
+
+// keyType TYPE key，key 不存在时返回 none
+func keyType(sc *ServerConnection, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'type' command"}
+	}
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	entry, ok := db.lookup(string(args[0].bulk))
+	if !ok {
+		return Value{typ: STRING, str: "none"}
+	}
+	return Value{typ: STRING, str: entry.Type}
+}
+
+// renameGeneric RENAME/RENAMENX key newkey，过期时间随 key 一起转移。
+// nx 为 true 时 newkey 已经存在就不改名并返回 0
+func renameGeneric(sc *ServerConnection, args []Value, name string, nx bool) Value {
+	if len(args) != 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+	key, newKey := string(args[0].bulk), string(args[1].bulk)
+	db := sc.database()
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	entry, ok := db.lookupForWrite(key)
+	if !ok {
+		return Value{typ: ERROR, str: "ERR no such key"}
+	}
+
+	// 改名为自己时 newkey 一定存在，RENAMENX 返回 0，RENAME 什么都不做
+	if _, exists := db.lookupForWrite(newKey); exists && nx {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	if key != newKey {
+		db.remove(key)
+		db.set(newKey, entry)
+		dirty.Add(1)
+	}
+	if nx {
+		return Value{typ: INTEGER, num: 1}
+	}
+	return Value{typ: STRING, str: "OK"}
+}
+
+func rename(sc *ServerConnection, args []Value) Value {
+	return renameGeneric(sc, args, "rename", false)
+}
+
+func renameNX(sc *ServerConnection, args []Value) Value {
+	return renameGeneric(sc, args, "renamenx", true)
+}
+
+// copyKey COPY source destination [DB destination-db] [REPLACE]，复制值和过期时间。
+// 目标 key 已经存在并且没有 REPLACE 时不复制并返回 0
+func copyKey(sc *ServerConnection, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'copy' command"}
+	}
+	src, dst := string(args[0].bulk), string(args[1].bulk)
+	target, replace := sc.db, false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i].bulk)); {
+		case option == "REPLACE":
+			replace = true
+		case option == "DB" && i+1 < len(args):
+			index, errValue := parseDBIndex(string(args[i+1].bulk))
+			if errValue != nil {
+				return *errValue
+			}
+			target = index
+			i++
+		default:
+			return Value{typ: ERROR, str: "ERR syntax error"}
+		}
+	}
+	if src == dst && target == sc.db {
+		return Value{typ: ERROR, str: "ERR source and destination objects are the same"}
+	}
+
+	from, to := sc.database(), databases[target]
+	if target == sc.db {
+		from.Mu.Lock()
+		defer from.Mu.Unlock()
+	} else {
+		unlock := lockDatabases(sc.db, target)
+		defer unlock()
+	}
+	entry, ok := from.lookupForWrite(src)
+	if !ok {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	if _, exists := to.lookupForWrite(dst); exists && !replace {
+		sc.skipPropagate()
+		return Value{typ: INTEGER, num: 0}
+	}
+	to.set(dst, entry.clone())
+	dirty.Add(1)
+	return Value{typ: INTEGER, num: 1}
+}
+
+// swapDB SWAPDB index1 index2，交换两个数据库的全部数据，连接上选择的编号不变
+func swapDB(sc *ServerConnection, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'swapdb' command"}
+	}
+	a, errValue := parseDBIndex(string(args[0].bulk))
+	if errValue != nil {
+		return Value{typ: ERROR, str: "ERR invalid first DB index"}
+	}
+	b, errValue := parseDBIndex(string(args[1].bulk))
+	if errValue != nil {
+		return Value{typ: ERROR, str: "ERR invalid second DB index"}
+	}
+	if a != b {
+		unlock := lockDatabases(a, b)
+		databases[a].Data, databases[b].Data = databases[b].Data, databases[a].Data
+		databases[a].Expires, databases[b].Expires = databases[b].Expires, databases[a].Expires
+		databases[a].Keys, databases[b].Keys = databases[b].Keys, databases[a].Keys
+		unlock()
+		dirty.Add(1)
+	}
+	return Value{typ: STRING, str: "OK"}
+}
+
+// checkFlushMode 检查 FLUSHDB/FLUSHALL 的 ASYNC|SYNC 参数
+func checkFlushMode(args []Value) *Value {
+	if len(args) == 0 {
+		return nil
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(string(args[0].bulk)) {
+		case "ASYNC", "SYNC":
+			return nil
+		}
+	}
+	return &Value{typ: ERROR, str: "ERR syntax error"}
+}
+
+// flush 清空一个数据库。旧的 map 整个换掉，由 GC 在后台回收，
+// 所以 ASYNC 和 SYNC 都不会在持有锁的时候逐个释放 key
+func (s *STORAGE) flush() {
+	s.Mu.Lock()
+	old := s.Data
+	s.Data = map[string]*Entry{}
+	s.Expires = map[string]struct{}{}
+	s.Keys = scanTable{}
+	s.Mu.Unlock()
+
+	dirty.Add(int64(len(old)))
+}
+
+func flushDB(sc *ServerConnection, args []Value) Value {
+	if errValue := checkFlushMode(args); errValue != nil {
+		return *errValue
+	}
+	sc.database().flush()
+	return Value{typ: STRING, str: "OK"}
+}
+
+func flushAll(sc *ServerConnection, args []Value) Value {
+	if errValue := checkFlushMode(args); errValue != nil {
+		return *errValue
+	}
+	for _, db := range databases {
+		db.flush()
+	}
+	return Value{typ: STRING, str: "OK"}
+}
+
+func dbSize(sc *ServerConnection, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: ERROR, str: "ERR wrong number of arguments for 'dbsize' command"}
+	}
+	db := sc.database()
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	return Value{typ: INTEGER, num: len(db.Data)}
+}
+
+// keyspaceInfo INFO keyspace 的内容，只列出非空的数据库
+func keyspaceInfo() string {
+	var sb strings.Builder
+	sb.WriteString("# Keyspace\r\n")
+	for i, db := range databases {
+		db.Mu.RLock()
+		keys, expires := len(db.Data), len(db.Expires)
+		db.Mu.RUnlock()
+		if keys > 0 {
+			sb.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d\r\n", i, keys, expires))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,191 @@
+package main
+
+import "testing"
+
+func TestTypedKeyspace(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	if got := call("RPUSH", "list", "a", "b"); got.typ != INTEGER || got.num != 2 {
+		t.Errorf("RPUSH list a b = %+v, want 2", got)
+	}
+	if got := call("RPUSH", "list", "c"); got.num != 3 {
+		t.Errorf("RPUSH list c = %+v, want 3", got)
+	}
+	if got := call("SADD", "set", "a", "b", "a"); got.num != 2 {
+		t.Errorf("SADD set a b a = %+v, want 2", got)
+	}
+	if got := call("ZADD", "zset", "1", "a", "2", "b"); got.num != 2 {
+		t.Errorf("ZADD zset = %+v, want 2", got)
+	}
+	// 更新已有成员的分数不算新增
+	if got := call("ZADD", "zset", "3", "a"); got.num != 0 {
+		t.Errorf("ZADD existing member = %+v, want 0", got)
+	}
+	if got := call("ZADD", "zset", "nan", "a"); got.typ != ERROR {
+		t.Errorf("ZADD with nan score = %+v, want an error", got)
+	}
+	if got := call("ZADD", "zset", "1", "a", "2"); got.str != "ERR syntax error" {
+		t.Errorf("ZADD with odd arguments = %+v, want a syntax error", got)
+	}
+
+	// 同一个 key 只能有一种类型
+	call("SET", "str", "v")
+	for _, args := range [][]string{
+		{"GET", "list"},
+		{"HGET", "str", "f"},
+		{"HSET", "set", "f", "v"},
+		{"RPUSH", "str", "a"},
+		{"SADD", "zset", "a"},
+		{"ZADD", "list", "1", "a"},
+	} {
+		if got := call(args...); got.str != WrongTypeError.str {
+			t.Errorf("%v = %+v, want WRONGTYPE", args, got)
+		}
+	}
+	if got := text(call("GET", "str")); got != "v" {
+		t.Errorf("GET str = %q, want %q", got, "v")
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	sc := &ServerConnection{}
+	for _, index := range []string{"-1", "16", "x"} {
+		if got := callOn(sc, "SELECT", index); got.typ != ERROR {
+			t.Errorf("SELECT %s = %+v, want an error", index, got)
+		}
+	}
+	callOn(sc, "SET", "k", "db0")
+	callOn(sc, "SELECT", "1")
+	if got := callOn(sc, "GET", "k"); got.typ != NULL {
+		t.Errorf("GET k in db 1 = %+v, want NULL", got)
+	}
+	callOn(sc, "SET", "k", "db1")
+	callOn(sc, "SET", "moved", "v")
+
+	// 目标库中已有同名 key 时不移动
+	if got := callOn(sc, "MOVE", "k", "0"); got.num != 0 {
+		t.Errorf("MOVE k 0 = %+v, want 0", got)
+	}
+	if got := callOn(sc, "MOVE", "moved", "0"); got.num != 1 {
+		t.Errorf("MOVE moved 0 = %+v, want 1", got)
+	}
+	if lookupEntryIn(1, "moved") != nil || lookupEntryIn(0, "moved") == nil {
+		t.Error("MOVE did not move the key from db 1 to db 0")
+	}
+	if got := callOn(sc, "MOVE", "k", "1"); got.typ != ERROR {
+		t.Errorf("MOVE to the selected db = %+v, want an error", got)
+	}
+
+	// SWAPDB 交换数据，连接选择的编号不变
+	if got := text(callOn(sc, "SWAPDB", "0", "1")); got != "OK" {
+		t.Fatalf("SWAPDB 0 1 = %q", got)
+	}
+	if got := text(callOn(sc, "GET", "k")); got != "db0" {
+		t.Errorf("GET k in db 1 after SWAPDB = %q, want %q", got, "db0")
+	}
+	if got := callOn(sc, "DBSIZE"); got.num != 2 {
+		t.Errorf("DBSIZE = %+v, want 2", got)
+	}
+
+	callOn(sc, "FLUSHDB")
+	if got := callOn(sc, "DBSIZE"); got.num != 0 {
+		t.Errorf("DBSIZE after FLUSHDB = %+v, want 0", got)
+	}
+	if lookupEntryIn(0, "k") == nil {
+		t.Error("FLUSHDB cleared another database")
+	}
+	callOn(sc, "FLUSHALL", "ASYNC")
+	if lookupEntryIn(0, "k") != nil {
+		t.Error("FLUSHALL left keys in db 0")
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps [][2]string // 命令和期望的返回值
+	}{
+		{"DEL and EXISTS", [][2]string{
+			{"SET a 1", "OK"},
+			{"RPUSH b x", "(integer) 1"},
+			{"EXISTS a b a missing", "(integer) 3"},
+			{"TOUCH a b missing", "(integer) 2"},
+			{"DEL a b missing", "(integer) 2"},
+			{"UNLINK a", "(integer) 0"},
+			{"EXISTS a b", "(integer) 0"},
+		}},
+		{"TYPE", [][2]string{
+			{"SET s v", "OK"},
+			{"HSET h f v", "(integer) 1"},
+			{"SADD set m", "(integer) 1"},
+			{"TYPE s", "string"},
+			{"TYPE h", "hash"},
+			{"TYPE set", "set"},
+			{"TYPE missing", "none"},
+		}},
+		{"RENAME", [][2]string{
+			{"RENAME a b", "ERR no such key"},
+			{"SET a 1 EX 100", "OK"},
+			{"SET b 2", "OK"},
+			{"RENAME a b", "OK"},
+			{"GET b", "1"},
+			{"TTL b", "(integer) 100"},
+			{"EXISTS a", "(integer) 0"},
+			{"RENAME b b", "OK"},
+			{"GET b", "1"},
+		}},
+		{"RENAMENX", [][2]string{
+			{"SET a 1", "OK"},
+			{"SET b 2", "OK"},
+			{"RENAMENX a b", "(integer) 0"},
+			{"RENAMENX a a", "(integer) 0"},
+			{"RENAMENX a c", "(integer) 1"},
+			{"GET c", "1"},
+			{"GET b", "2"},
+		}},
+		{"COPY", [][2]string{
+			{"COPY a b", "(integer) 0"},
+			{"SET a 1 EX 100", "OK"},
+			{"COPY a a", "ERR source and destination objects are the same"},
+			{"COPY a b", "(integer) 1"},
+			{"TTL b", "(integer) 100"},
+			{"SET a 2", "OK"},
+			{"COPY a b", "(integer) 0"},
+			{"GET b", "1"},
+			{"COPY a b REPLACE", "(integer) 1"},
+			{"GET b", "2"},
+			{"COPY a b FOO", "ERR syntax error"},
+			{"COPY a b DB 16", "ERR DB index is out of range"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore()
+			t.Cleanup(resetStore)
+			runSteps(t, tt.steps)
+		})
+	}
+}
+
+func TestCopyToDatabase(t *testing.T) {
+	resetStore()
+	t.Cleanup(resetStore)
+
+	call("RPUSH", "list", "a", "b")
+	if got := call("COPY", "list", "list", "DB", "2"); got.num != 1 {
+		t.Fatalf("COPY list list DB 2 = %+v, want 1", got)
+	}
+	// 复制出来的值和原来的互不影响
+	call("RPUSH", "list", "c")
+	entry := lookupEntryIn(2, "list")
+	if entry == nil {
+		t.Fatal("COPY did not create the key in db 2")
+	}
+	if got := entry.Value.([]string); len(got) != 2 {
+		t.Errorf("copied list = %v, want [a b]", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// tls-auth-clients 的取值
+const (
+	TlsAuthClientsYes      = "yes"
+	TlsAuthClientsNo       = "no"
+	TlsAuthClientsOptional = "optional"
+)
+
+// tlsMaterial 一组已经加载好的证书，重新加载时整个替换
+type tlsMaterial struct {
+	cert       tls.Certificate
+	clientCAs  *x509.CertPool
+	clientAuth tls.ClientAuthType
+}
+
+// tlsSettings 加载证书需要的配置项
+type tlsSettings struct {
+	certFile, keyFile, caCertFile, authClients string
+}
+
+// TLS 当前使用的证书，新连接握手时读取，所以重新加载后不需要重启，已经建立的连接不受影响
+var TLS = struct {
+	mu       sync.RWMutex
+	material *tlsMaterial
+}{}
+
+// currentTLSSettings 从 Configs 中读取 TLS 配置，调用方需要持有 ConfigsMu
+func currentTLSSettings() tlsSettings {
+	return tlsSettings{
+		certFile:    Configs["tls-cert-file"],
+		keyFile:     Configs["tls-key-file"],
+		caCertFile:  Configs["tls-ca-cert-file"],
+		authClients: Configs["tls-auth-clients"],
+	}
+}
+
+func loadTLSMaterial(settings tlsSettings) (*tlsMaterial, error) {
+	if settings.certFile == "" || settings.keyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file must both be set")
+	}
+	cert, err := tls.LoadX509KeyPair(settings.certFile, settings.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	material := &tlsMaterial{cert: cert}
+
+	switch settings.authClients {
+	case TlsAuthClientsYes:
+		material.clientAuth = tls.RequireAndVerifyClientCert
+	case TlsAuthClientsOptional:
+		material.clientAuth = tls.VerifyClientCertIfGiven
+	case TlsAuthClientsNo:
+		material.clientAuth = tls.NoClientCert
+	default:
+		return nil, errors.New("tls-auth-clients must be one of: yes, no, optional")
+	}
+	if material.clientAuth == tls.NoClientCert {
+		return material, nil
+	}
+
+	if settings.caCertFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to authenticate clients")
+	}
+	pem, err := os.ReadFile(settings.caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	material.clientCAs = x509.NewCertPool()
+	if !material.clientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + settings.caCertFile)
+	}
+	return material, nil
+}
+
+// reloadTLS 重新加载证书，失败时继续使用原来的证书
+func reloadTLS(settings tlsSettings) error {
+	material, err := loadTLSMaterial(settings)
+	if err != nil {
+		return err
+	}
+	TLS.mu.Lock()
+	TLS.material = material
+	TLS.mu.Unlock()
+	return nil
+}
+
+// tlsEnabled 是否配置了 tls-port，调用方需要持有 ConfigsMu
+func tlsEnabled() bool {
+	return Configs["tls-port"] != ""
+}
+
+// newTLSConfig 每次握手时按当前加载的证书生成配置
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			TLS.mu.RLock()
+			material := TLS.material
+			TLS.mu.RUnlock()
+			return &tls.Config{
+				Certificates: []tls.Certificate{material.cert},
+				ClientCAs:    material.clientCAs,
+				ClientAuth:   material.clientAuth,
+				MinVersion:   tls.VersionTLS12,
+			}, nil
+		},
+	}
+}
+
+// tlsConfigSetter 修改一个 TLS 配置项。开启了 TLS 时用新的值重新加载证书，加载失败则拒绝修改；
+// 对 tls-cert-file 等配置项 SET 相同的值就可以在替换证书文件后重新加载
+func tlsConfigSetter(key string) func(value string) error {
+	return func(value string) error {
+		settings := currentTLSSettings()
+		switch key {
+		case "tls-cert-file":
+			settings.certFile = value
+		case "tls-key-file":
+			settings.keyFile = value
+		case "tls-ca-cert-file":
+			settings.caCertFile = value
+		case "tls-auth-clients":
+			settings.authClients = value
+		}
+		if !tlsEnabled() {
+			return nil
+		}
+		return reloadTLS(settings)
+	}
+}
+
+// tlsVersionName TLS 版本的名称，使用 OpenSSL 的写法
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}